@@ -0,0 +1,87 @@
+package calc
+
+import "math"
+
+// Operation - то, что умеет вычислитель. TimeEnv - переменная окружения
+// со временем выполнения в секундах, MinArgs - минимальное число аргументов.
+type Operation struct {
+	TimeEnv string
+	MinArgs int
+	Calc    func(args []float64) float64
+}
+
+var Operations = map[string]Operation{
+	"+":    {"TIME_ADD", 2, func(a []float64) float64 { return a[0] + a[1] }},
+	"-":    {"TIME_SUBSTR", 2, func(a []float64) float64 { return a[0] - a[1] }},
+	"*":    {"TIME_MULT", 2, func(a []float64) float64 { return a[0] * a[1] }},
+	"/":    {"TIME_DIVISION", 2, func(a []float64) float64 { return a[0] / a[1] }},
+	"^":    {"TIME_POW", 2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"neg":  {"TIME_SUBSTR", 1, func(a []float64) float64 { return -a[0] }},
+	"sqrt": {"TIME_SQRT", 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"abs":  {"TIME_ABS", 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"min": {"TIME_MIN", 1, func(a []float64) float64 {
+		res := a[0]
+		for _, x := range a[1:] {
+			res = math.Min(res, x)
+		}
+		return res
+	}},
+	"max": {"TIME_MAX", 1, func(a []float64) float64 {
+		res := a[0]
+		for _, x := range a[1:] {
+			res = math.Max(res, x)
+		}
+		return res
+	}},
+	"log": {"TIME_LOG", 1, func(a []float64) float64 {
+		if len(a) == 1 {
+			return math.Log(a[0])
+		}
+		return math.Log(a[0]) / math.Log(a[1])
+	}},
+	// результат другого выражения без изменений, в тексте выражения недоступна
+	"ref": {"", 1, func(a []float64) float64 { return a[0] }},
+	"<":   {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] < a[1]) }},
+	"<=":  {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] <= a[1]) }},
+	">":   {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] > a[1]) }},
+	">=":  {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] >= a[1]) }},
+	"==":  {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] == a[1]) }},
+	"!=":  {"TIME_COMPARE", 2, func(a []float64) float64 { return boolToFloat(a[0] != a[1]) }},
+	"&&":  {"TIME_LOGIC", 2, func(a []float64) float64 { return boolToFloat(a[0] != 0 && a[1] != 0) }},
+	"||":  {"TIME_LOGIC", 2, func(a []float64) float64 { return boolToFloat(a[0] != 0 || a[1] != 0) }},
+	"not": {"TIME_LOGIC", 1, func(a []float64) float64 { return boolToFloat(a[0] == 0) }},
+	// выбор ветки c ? a : b; аргумент невыбранной ветки не вычисляется и равен 0
+	"if": {"", 3, func(a []float64) float64 {
+		if a[0] != 0 {
+			return a[1]
+		}
+		return a[2]
+	}},
+	// половины округляются от нуля: round(-2.5) = -3
+	"round": {"TIME_ROUND", 1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"floor": {"TIME_FLOOR", 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {"TIME_CEIL", 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	// отбрасывает дробную часть: trunc(-2.7) = -2
+	"trunc": {"TIME_TRUNC", 1, func(a []float64) float64 { return math.Trunc(a[0]) }},
+	// остаток имеет знак делителя: -7 % 3 = 2, 7 % -3 = -2
+	"%": {"TIME_MOD", 2, func(a []float64) float64 { return mod(a[0], a[1]) }},
+	// деление с округлением вниз: -7 // 2 = -4
+	"//": {"TIME_FLOORDIV", 2, func(a []float64) float64 { return math.Floor(a[0] / a[1]) }},
+}
+
+// mod - остаток от деления с округлением вниз, a == (a // b) * b + a % b
+func mod(a, b float64) float64 {
+	m := math.Mod(a, b)
+	if m != 0 && (m < 0) != (b < 0) {
+		m += b
+	}
+	return m
+}
+
+// истина - 1, ложь - 0; в условиях истинно любое ненулевое число
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
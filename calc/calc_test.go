@@ -0,0 +1,203 @@
+package calc
+
+import (
+	"math"
+	"math/big"
+	"slices"
+	"testing"
+)
+
+func TestOperations(t *testing.T) {
+	tests := []struct {
+		oper string
+		args []float64
+		want float64
+	}{
+		{"+", []float64{0.5, 2}, 2.5},
+		{"/", []float64{1, 4}, 0.25},
+		{"^", []float64{2, 10}, 1024},
+		{"neg", []float64{3}, -3},
+		{"min", []float64{3, -1, 2}, -1},
+		{"max", []float64{3, -1, 2}, 3},
+		// остаток имеет знак делителя, // округляет вниз
+		{"%", []float64{7, 3}, 1},
+		{"%", []float64{-7, 3}, 2},
+		{"%", []float64{7, -3}, -2},
+		{"%", []float64{-7, -3}, -1},
+		{"%", []float64{6, -3}, 0},
+		{"//", []float64{7, 2}, 3},
+		{"//", []float64{-7, 2}, -4},
+		{"//", []float64{7, -2}, -4},
+		{"//", []float64{-7, -2}, 3},
+		{"round", []float64{-2.5}, -3},
+		{"round", []float64{2.5}, 3},
+		{"trunc", []float64{-2.7}, -2},
+		{"floor", []float64{-2.1}, -3},
+		{"ceil", []float64{-2.9}, -2},
+		{"<=", []float64{2, 2}, 1},
+		{"!=", []float64{2, 2}, 0},
+		{"&&", []float64{2, 0}, 0},
+		{"||", []float64{0, -1}, 1},
+		{"not", []float64{0}, 1},
+		{"if", []float64{0, 1, 2}, 2},
+	}
+	for _, test := range tests {
+		if got := Operations[test.oper].Calc(test.args); got != test.want {
+			t.Errorf("%s%v = %v, want %v", test.oper, test.args, got, test.want)
+		}
+	}
+
+	// a == (a // b) * b + a % b
+	for _, a := range []float64{-7, -6, 5, 7} {
+		for _, b := range []float64{-3, 2, 3} {
+			q := Operations["//"].Calc([]float64{a, b})
+			m := Operations["%"].Calc([]float64{a, b})
+			if q*b+m != a {
+				t.Errorf("%v // %v = %v, %v %% %v = %v: identity does not hold", a, b, q, a, b, m)
+			}
+		}
+	}
+	if got := Operations["%"].Calc([]float64{1, 0}); !math.IsNaN(got) {
+		t.Errorf("1 %% 0 = %v, want NaN", got)
+	}
+}
+
+func TestElementwise(t *testing.T) {
+	tests := []struct {
+		oper string
+		args []Value
+		want []float64
+		err  error
+	}{
+		{"*", []Value{{List: []float64{1, 2, 3}}, {Number: 2}}, []float64{2, 4, 6}, nil},
+		{"-", []Value{{Number: 10}, {List: []float64{1, 2}}}, []float64{9, 8}, nil},
+		{"+", []Value{{List: []float64{1, 2}}, {List: []float64{10, 20}}}, []float64{11, 22}, nil},
+		{"sqrt", []Value{{List: []float64{4, 9}}}, []float64{2, 3}, nil},
+		{"%", []Value{{List: []float64{-7, 7}}, {Number: 3}}, []float64{2, 1}, nil},
+		{"+", []Value{{List: []float64{1, 2}}, {List: []float64{1, 2, 3}}}, nil, errListLength},
+	}
+	for _, test := range tests {
+		got, err := Elementwise(Operations[test.oper], test.args)
+		if err != test.err || !slices.Equal(got.List, test.want) {
+			t.Errorf("Elementwise(%s, %v) = %v, %v; want %v, %v", test.oper, test.args, got.List, err, test.want, test.err)
+		}
+	}
+}
+
+func TestListOperations(t *testing.T) {
+	list := func(values ...float64) Value { return Value{List: values} }
+	tests := []struct {
+		oper string
+		args []Value
+		want Value
+		err  error
+	}{
+		{"list", []Value{{Number: 1}, {Number: 2}}, list(1, 2), nil},
+		{"list", []Value{{Number: 1}, list(2)}, Value{}, errNestedList},
+		{"concat", []Value{list(1, 2), list(3)}, list(1, 2, 3), nil},
+		{"concat", []Value{list(1), {Number: 2}}, Value{}, errNotList},
+		{"sum", []Value{list(1, 2, 3.5)}, Value{Number: 6.5}, nil},
+		{"sum", []Value{{Number: 1}}, Value{}, errNotList},
+		{"product", []Value{list(2, 3, 4)}, Value{Number: 24}, nil},
+		{"avg", []Value{list(1, 2, 6)}, Value{Number: 3}, nil},
+		{"dot", []Value{list(1, 2, 3), list(4, 5, 6)}, Value{Number: 32}, nil},
+		{"dot", []Value{list(1, 2), list(1)}, Value{}, errListLength},
+	}
+	for _, test := range tests {
+		got, err := ListOperations[test.oper].Calc(test.args)
+		if err != test.err || got.Number != test.want.Number || !slices.Equal(got.List, test.want.List) {
+			t.Errorf("%s%v = %v, %v; want %v, %v", test.oper, test.args, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRangeOperations(t *testing.T) {
+	for oper, want := range map[string]float64{"sum_range": 10, "product_range": 24} {
+		op := RangeOperations[oper]
+		res := op.Init
+		for i := 1.0; i <= 4; i++ {
+			res = op.Reduce(res, i)
+		}
+		if res != want {
+			t.Errorf("%s over 1..4 = %v, want %v", oper, res, want)
+		}
+	}
+}
+
+func TestExactOperations(t *testing.T) {
+	tests := []struct {
+		oper string
+		args []string
+		// пустая строка - точного результата нет
+		want string
+	}{
+		{"+", []string{"0.1", "0.2"}, "0.3"},
+		{"-", []string{"0.3", "0.1"}, "0.2"},
+		{"*", []string{"1.1", "1.1"}, "1.21"},
+		{"/", []string{"1", "3"}, "1/3"},
+		{"/", []string{"1", "8"}, "0.125"},
+		{"/", []string{"1", "0"}, ""},
+		{"^", []string{"2", "-2"}, "0.25"},
+		{"^", []string{"1/3", "3"}, "1/27"},
+		{"^", []string{"2", "0.5"}, ""},
+		{"^", []string{"0", "-1"}, ""},
+		{"^", []string{"2", "5000"}, ""},
+		{"sqrt", []string{"9/4"}, "1.5"},
+		{"sqrt", []string{"2"}, ""},
+		{"sqrt", []string{"-4"}, ""},
+		{"%", []string{"-7", "3"}, "2"},
+		{"%", []string{"7", "-3"}, "-2"},
+		{"%", []string{"0.5", "0.2"}, "0.1"},
+		{"%", []string{"1", "0"}, ""},
+		{"//", []string{"-7", "2"}, "-4"},
+		{"//", []string{"7", "-2"}, "-4"},
+		{"round", []string{"-2.5"}, "-3"},
+		{"round", []string{"2.49"}, "2"},
+		{"trunc", []string{"-2.7"}, "-2"},
+		{"floor", []string{"-2.1"}, "-3"},
+		{"ceil", []string{"-2.9"}, "-2"},
+		{"ceil", []string{"2.1"}, "3"},
+		{"min", []string{"1/3", "0.3"}, "0.3"},
+		{"<", []string{"1/3", "0.3333"}, "0"},
+		{"==", []string{"0.5", "1/2"}, "1"},
+		{"if", []string{"0", "1", "2"}, "2"},
+	}
+	for _, test := range tests {
+		args := make([]*big.Rat, len(test.args))
+		for i, arg := range test.args {
+			var ok bool
+			if args[i], ok = ParseExact(arg); !ok {
+				t.Fatalf("ParseExact(%q) failed", arg)
+			}
+		}
+		res, ok := ExactOperations[test.oper](args)
+		got := ""
+		if ok {
+			got = FormatExact(res)
+		}
+		if got != test.want {
+			t.Errorf("%s%v = %q, want %q", test.oper, test.args, got, test.want)
+		}
+	}
+}
+
+func TestFormatExact(t *testing.T) {
+	tests := map[string]string{
+		"3":      "3",
+		"-0.5":   "-0.5",
+		"1/3":    "1/3",
+		"7/20":   "0.35",
+		"100/8":  "12.5",
+		"1/1024": "0.0009765625",
+		"-2/6":   "-1/3",
+	}
+	for in, want := range tests {
+		x, ok := ParseExact(in)
+		if !ok {
+			t.Fatalf("ParseExact(%q) failed", in)
+		}
+		if got := FormatExact(x); got != want {
+			t.Errorf("FormatExact(%s) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package calc
+
+import (
+	"math/big"
+	"strings"
+)
+
+// наибольший показатель степени, который считается точно:
+// дальше числитель и знаменатель растут слишком сильно
+const maxExactPow = 4096
+
+// ExactOperations - точные версии операций над рациональными числами.
+// false - результат нельзя записать точно (деление на 0, корень не из квадрата,
+// дробная степень, логарифм), тогда вычислитель считает как обычно.
+var ExactOperations = map[string]func(args []*big.Rat) (*big.Rat, bool){
+	"+": func(a []*big.Rat) (*big.Rat, bool) { return new(big.Rat).Add(a[0], a[1]), true },
+	"-": func(a []*big.Rat) (*big.Rat, bool) { return new(big.Rat).Sub(a[0], a[1]), true },
+	"*": func(a []*big.Rat) (*big.Rat, bool) { return new(big.Rat).Mul(a[0], a[1]), true },
+	"/": func(a []*big.Rat) (*big.Rat, bool) {
+		if a[1].Sign() == 0 {
+			return nil, false
+		}
+		return new(big.Rat).Quo(a[0], a[1]), true
+	},
+	"^":   exactPow,
+	"neg": func(a []*big.Rat) (*big.Rat, bool) { return new(big.Rat).Neg(a[0]), true },
+	"ref": func(a []*big.Rat) (*big.Rat, bool) { return a[0], true },
+	"abs": func(a []*big.Rat) (*big.Rat, bool) { return new(big.Rat).Abs(a[0]), true },
+	"sqrt": func(a []*big.Rat) (*big.Rat, bool) {
+		if a[0].Sign() < 0 {
+			return nil, false
+		}
+		num, ok := exactSqrt(a[0].Num())
+		if !ok {
+			return nil, false
+		}
+		denom, ok := exactSqrt(a[0].Denom())
+		if !ok {
+			return nil, false
+		}
+		return new(big.Rat).SetFrac(num, denom), true
+	},
+	"min": func(a []*big.Rat) (*big.Rat, bool) {
+		res := a[0]
+		for _, x := range a[1:] {
+			if x.Cmp(res) < 0 {
+				res = x
+			}
+		}
+		return res, true
+	},
+	"max": func(a []*big.Rat) (*big.Rat, bool) {
+		res := a[0]
+		for _, x := range a[1:] {
+			if x.Cmp(res) > 0 {
+				res = x
+			}
+		}
+		return res, true
+	},
+	"<":   exactCompare(func(c int) bool { return c < 0 }),
+	"<=":  exactCompare(func(c int) bool { return c <= 0 }),
+	">":   exactCompare(func(c int) bool { return c > 0 }),
+	">=":  exactCompare(func(c int) bool { return c >= 0 }),
+	"==":  exactCompare(func(c int) bool { return c == 0 }),
+	"!=":  exactCompare(func(c int) bool { return c != 0 }),
+	"&&":  func(a []*big.Rat) (*big.Rat, bool) { return exactBool(a[0].Sign() != 0 && a[1].Sign() != 0), true },
+	"||":  func(a []*big.Rat) (*big.Rat, bool) { return exactBool(a[0].Sign() != 0 || a[1].Sign() != 0), true },
+	"not": func(a []*big.Rat) (*big.Rat, bool) { return exactBool(a[0].Sign() == 0), true },
+	"if": func(a []*big.Rat) (*big.Rat, bool) {
+		if a[0].Sign() != 0 {
+			return a[1], true
+		}
+		return a[2], true
+	},
+	"%": func(a []*big.Rat) (*big.Rat, bool) {
+		if a[1].Sign() == 0 {
+			return nil, false
+		}
+		q := exactFloor(new(big.Rat).Quo(a[0], a[1]))
+		return new(big.Rat).Sub(a[0], q.Mul(q, a[1])), true
+	},
+	"//": func(a []*big.Rat) (*big.Rat, bool) {
+		if a[1].Sign() == 0 {
+			return nil, false
+		}
+		return exactFloor(new(big.Rat).Quo(a[0], a[1])), true
+	},
+	"floor": func(a []*big.Rat) (*big.Rat, bool) { return exactFloor(a[0]), true },
+	"ceil": func(a []*big.Rat) (*big.Rat, bool) {
+		x := exactFloor(new(big.Rat).Neg(a[0]))
+		return x.Neg(x), true
+	},
+	"trunc": func(a []*big.Rat) (*big.Rat, bool) {
+		return new(big.Rat).SetInt(new(big.Int).Quo(a[0].Num(), a[0].Denom())), true
+	},
+	"round": func(a []*big.Rat) (*big.Rat, bool) {
+		x := new(big.Rat).Abs(a[0])
+		x = exactFloor(x.Add(x, big.NewRat(1, 2)))
+		if a[0].Sign() < 0 {
+			x.Neg(x)
+		}
+		return x, true
+	},
+}
+
+// exactFloor - наибольшее целое, не большее x. Знаменатель Rat всегда
+// положителен, поэтому евклидово деление Int.Div округляет вниз.
+func exactFloor(x *big.Rat) *big.Rat {
+	return new(big.Rat).SetInt(new(big.Int).Div(x.Num(), x.Denom()))
+}
+
+// exactCompare - точная версия сравнения: cmp получает результат Rat.Cmp
+func exactCompare(cmp func(int) bool) func(a []*big.Rat) (*big.Rat, bool) {
+	return func(a []*big.Rat) (*big.Rat, bool) {
+		return exactBool(cmp(a[0].Cmp(a[1]))), true
+	}
+}
+
+func exactBool(b bool) *big.Rat {
+	return big.NewRat(int64(boolToFloat(b)), 1)
+}
+
+func exactPow(a []*big.Rat) (*big.Rat, bool) {
+	if !a[1].IsInt() || !a[1].Num().IsInt64() {
+		return nil, false
+	}
+	n := a[1].Num().Int64()
+	if n > maxExactPow || n < -maxExactPow || n < 0 && a[0].Sign() == 0 {
+		return nil, false
+	}
+	base := a[0]
+	if n < 0 {
+		base = new(big.Rat).Inv(base)
+		n = -n
+	}
+	exp := big.NewInt(n)
+	num := new(big.Int).Exp(base.Num(), exp, nil)
+	denom := new(big.Int).Exp(base.Denom(), exp, nil)
+	return new(big.Rat).SetFrac(num, denom), true
+}
+
+func exactSqrt(x *big.Int) (*big.Int, bool) {
+	root := new(big.Int).Sqrt(x)
+	return root, new(big.Int).Mul(root, root).Cmp(x) == 0
+}
+
+// ParseExact разбирает точное значение: десятичную дробь или "p/q".
+func ParseExact(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(s)
+}
+
+// FormatExact записывает число десятичной дробью, если это можно сделать
+// без потерь, и дробью "p/q" иначе.
+func FormatExact(x *big.Rat) string {
+	if x.IsInt() {
+		return x.Num().String()
+	}
+	// дробь конечна, если в знаменателе только двойки и пятёрки
+	denom := new(big.Int).Set(x.Denom())
+	digits := 0
+	for _, p := range []int64{2, 5} {
+		d := big.NewInt(p)
+		count := 0
+		for new(big.Int).Mod(denom, d).Sign() == 0 {
+			denom.Quo(denom, d)
+			count++
+		}
+		digits = max(digits, count)
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return x.String()
+	}
+	return strings.TrimRight(x.FloatString(digits), "0")
+}
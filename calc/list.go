@@ -0,0 +1,132 @@
+package calc
+
+import "errors"
+
+// Value - аргумент или результат операции: число Number или, если
+// List != nil, список чисел. Пустых списков не бывает.
+type Value struct {
+	Number float64
+	List   []float64
+}
+
+// ListOperation - операция, которая работает со списками целиком.
+type ListOperation struct {
+	TimeEnv string
+	MinArgs int
+	Calc    func(args []Value) (Value, error)
+}
+
+var ListOperations = map[string]ListOperation{
+	// список из чисел-аргументов: [x, y + 1]
+	"list": {"", 1, func(a []Value) (Value, error) {
+		res := make([]float64, len(a))
+		for i, x := range a {
+			if x.List != nil {
+				return Value{}, errNestedList
+			}
+			res[i] = x.Number
+		}
+		return Value{List: res}, nil
+	}},
+	// склеивает части списка, которые считали разные вычислители
+	"concat": {"", 1, func(a []Value) (Value, error) {
+		var res []float64
+		for _, x := range a {
+			if x.List == nil {
+				return Value{}, errNotList
+			}
+			res = append(res, x.List...)
+		}
+		return Value{List: res}, nil
+	}},
+	"sum": {"TIME_SUM", 1, func(a []Value) (Value, error) {
+		if a[0].List == nil {
+			return Value{}, errNotList
+		}
+		return Value{Number: sum(a[0].List)}, nil
+	}},
+	"product": {"TIME_PRODUCT", 1, func(a []Value) (Value, error) {
+		if a[0].List == nil {
+			return Value{}, errNotList
+		}
+		res := 1.0
+		for _, x := range a[0].List {
+			res *= x
+		}
+		return Value{Number: res}, nil
+	}},
+	"avg": {"TIME_AVG", 1, func(a []Value) (Value, error) {
+		if a[0].List == nil {
+			return Value{}, errNotList
+		}
+		return Value{Number: sum(a[0].List) / float64(len(a[0].List))}, nil
+	}},
+	// скалярное произведение списков одной длины
+	"dot": {"TIME_DOT", 2, func(a []Value) (Value, error) {
+		if a[0].List == nil || a[1].List == nil {
+			return Value{}, errNotList
+		}
+		if len(a[0].List) != len(a[1].List) {
+			return Value{}, errListLength
+		}
+		res := 0.0
+		for i, x := range a[0].List {
+			res += x * a[1].List[i]
+		}
+		return Value{Number: res}, nil
+	}},
+}
+
+var (
+	errListLength = errors.New("list lengths differ")
+	errNotList    = errors.New("expected a list")
+	errNestedList = errors.New("nested lists are not supported")
+)
+
+func sum(list []float64) float64 {
+	res := 0.0
+	for _, x := range list {
+		res += x
+	}
+	return res
+}
+
+// Elementwise выполняет операцию из Operations для каждого элемента списков.
+// Число в паре со списком повторяется для каждого элемента: [1, 2] * 2 = [2, 4].
+func Elementwise(op Operation, args []Value) (Value, error) {
+	n := 0
+	for _, arg := range args {
+		if arg.List == nil {
+			continue
+		}
+		if n != 0 && len(arg.List) != n {
+			return Value{}, errListLength
+		}
+		n = len(arg.List)
+	}
+	res := make([]float64, n)
+	values := make([]float64, len(args))
+	for i := range res {
+		for j, arg := range args {
+			values[j] = arg.Number
+			if arg.List != nil {
+				values[j] = arg.List[i]
+			}
+		}
+		res[i] = op.Calc(values)
+	}
+	return Value{List: res}, nil
+}
+
+// IsKnown - операцию умеет вычислитель: она есть в Operations, ListOperations
+// или RangeOperations.
+func IsKnown(oper string) bool {
+	_, ok := Operations[oper]
+	if !ok {
+		_, ok = ListOperations[oper]
+	}
+	if !ok {
+		_, ok = RangeOperations[oper]
+	}
+	return ok
+}
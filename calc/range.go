@@ -0,0 +1,16 @@
+package calc
+
+// RangeOperation - свёртка выражения по всем целым i из диапазона [from, to]:
+// sum(i, 1, 100, i * i). Выражение вычислитель получает текстом
+// и считает сам, см. parser.Evaluate.
+type RangeOperation struct {
+	TimeEnv string
+	// результат для пустого диапазона
+	Init   float64
+	Reduce func(acc, x float64) float64
+}
+
+var RangeOperations = map[string]RangeOperation{
+	"sum_range":     {"TIME_SUM", 0, func(acc, x float64) float64 { return acc + x }},
+	"product_range": {"TIME_PRODUCT", 1, func(acc, x float64) float64 { return acc * x }},
+}
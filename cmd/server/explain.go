@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+	parser "github.com/Zheleznov-Fedor/new-ya-long-calc/expr_parser"
+)
+
+type (
+	// traceStep - одна посчитанная операция: "6 = 2 * 3", кто её посчитал и сколько считал.
+	// Аргументы - числа или списки.
+	traceStep struct {
+		Id         int64     `json:"id"`
+		Step       string    `json:"step"`
+		Oper       string    `json:"oper"`
+		Args       []any     `json:"args"`
+		Res        float64   `json:"res"`
+		ResList    []float64 `json:"res_list,omitempty"`
+		ExactRes   string    `json:"exact_res,omitempty"`
+		Worker     string    `json:"worker"`
+		DurationMs float64   `json:"duration_ms"`
+	}
+	explainResponse struct {
+		db.Expression
+		Trace []traceStep `json:"trace"`
+	}
+)
+
+// number - число для записи шага, точное значение предпочтительнее
+func number(value float64, exact string) parser.Node {
+	return &parser.Literal{Value: value, Text: exact}
+}
+
+// в записи шага у длинного списка видны только первые и последний элементы
+const traceListItems = 5
+
+func list(values []float64) parser.Node {
+	n := &parser.List{}
+	for i, x := range values {
+		if len(values) > traceListItems && i == traceListItems-1 {
+			n.Elems = append(n.Elems, &parser.Variable{Name: "..."}, number(values[len(values)-1], ""))
+			break
+		}
+		n.Elems = append(n.Elems, number(x, ""))
+	}
+	return n
+}
+
+// stepText записывает операцию над её аргументами так же, как она выглядела бы в выражении.
+// У операции над частью списков показываются только эти части.
+func stepText(o db.Operation) string {
+	args := make([]parser.Node, len(o.Args))
+	lists := o.SliceArgs()
+	for i, arg := range o.Args {
+		if lists[i] != nil {
+			args[i] = list(lists[i])
+			continue
+		}
+		exact := arg.Exact
+		if strings.Contains(exact, "/") {
+			// дробь p/q в аргументе читалась бы как деление
+			exact = "(" + exact + ")"
+		}
+		args[i] = number(arg.Value, exact)
+	}
+	if o.Body != "" {
+		return rangeText(o, args)
+	}
+	switch o.Oper {
+	case "ref":
+		return args[0].String()
+	case "neg":
+		return "-(" + args[0].String() + ")"
+	case "not":
+		return (&parser.Unary{Op: "!", X: args[0]}).String()
+	case "if":
+		return (&parser.Conditional{Cond: args[0], Then: args[1], Else: args[2]}).String()
+	case "list":
+		return (&parser.List{Elems: args}).String()
+	case "concat":
+		// склеиваемые части - всегда списки, даже пустые
+		parts := make([]parser.Node, len(o.Args))
+		for i, arg := range o.Args {
+			parts[i] = list(arg.List)
+		}
+		return (&parser.Call{Name: o.Oper, Args: parts}).String()
+	}
+	if unicode.IsLetter([]rune(o.Oper)[0]) {
+		return (&parser.Call{Name: o.Oper, Args: args}).String()
+	}
+	return (&parser.Binary{Op: o.Oper, Left: args[0], Right: args[1]}).String()
+}
+
+// rangeText записывает часть свёртки по диапазону: sum(i, 1, 1000, i * 2),
+// значения из аргументов подставляются в тело
+func rangeText(o db.Operation, args []parser.Node) string {
+	body, err := parser.Parse(o.Body)
+	if err != nil || len(o.Params) == 0 || len(args) != len(o.Params)+1 {
+		return o.Oper + "(" + o.Body + ")"
+	}
+	values := map[string]parser.Node{}
+	for i, name := range o.Params[1:] {
+		values[name] = args[i+2]
+	}
+	name := strings.TrimSuffix(o.Oper, "_range")
+	index := &parser.Variable{Name: o.Params[0]}
+	return (&parser.Call{Name: name, Args: []parser.Node{index, args[0], args[1], parser.Substitute(body, values)}}).String()
+}
+
+func buildTrace(opers []db.Operation) []traceStep {
+	trace := []traceStep{}
+	for _, o := range opers {
+		res := number(o.Res.Float64, o.ExactRes.String)
+		if o.ResList != nil {
+			res = list(o.ResList)
+		}
+		step := traceStep{
+			Id:         o.Id,
+			Step:       res.String() + " = " + stepText(o),
+			Oper:       o.Oper,
+			Args:       []any{},
+			Res:        o.Res.Float64,
+			ResList:    o.ResList,
+			ExactRes:   o.ExactRes.String,
+			Worker:     o.Worker.String,
+			DurationMs: o.DurationMs.Float64,
+		}
+		for i, arg := range o.SliceArgs() {
+			if arg != nil {
+				step.Args = append(step.Args, arg)
+				continue
+			}
+			step.Args = append(step.Args, o.Args[i].Value)
+		}
+		trace = append(trace, step)
+	}
+	return trace
+}
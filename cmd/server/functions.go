@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+	parser "github.com/Zheleznov-Fedor/new-ya-long-calc/expr_parser"
+)
+
+// functionsHandler: GET - функции пользователя, POST - определить новую
+// функцию или заменить одноимённую, например "vat(x) = x * 1.2".
+func functionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+	userId := int64(requestClaims(r)["userId"].(float64))
+
+	switch r.Method {
+	case http.MethodGet:
+		funcs, err := db.SelectFunctionsByUser(ctx, database, userId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "some DataBase error", http.StatusInternalServerError)
+			return
+		}
+		if funcs == nil {
+			funcs = []db.Function{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(funcs)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case http.MethodPost:
+		var req struct {
+			Definition string `json:"definition"`
+		}
+		var body json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err == nil && len(body) > 0 && body[0] == '"' {
+			err = json.Unmarshal(body, &req.Definition)
+		} else if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+
+		f, err := parser.ParseFunction(req.Definition)
+		if err != nil {
+			writeParseError(w, err)
+			return
+		}
+		funcs, err := parser.LoadFunctions(ctx, database, userId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "some DataBase error", http.StatusInternalServerError)
+			return
+		}
+		err = parser.CheckFunction(f, funcs)
+		if err != nil {
+			writeParseError(w, err)
+			return
+		}
+		stored := db.Function{Name: f.Name, Params: f.Params, Body: f.Body.String()}
+		err = db.SaveFunction(ctx, database, userId, stored)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "some DataBase error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(stored)
+		if err != nil {
+			fmt.Println(err)
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
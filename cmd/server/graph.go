@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+)
+
+type (
+	graphOperand struct {
+		Value *float64 `json:"value"`
+		Ready bool     `json:"ready"`
+		// аргумент-список, тогда value пустое
+		List []float64 `json:"list,omitempty"`
+	}
+	graphNode struct {
+		Id    int64          `json:"id"`
+		Oper  string         `json:"oper"`
+		Args  []graphOperand `json:"args"`
+		State string         `json:"state"`
+		Res   *float64       `json:"res"`
+		Final bool           `json:"final"`
+		// результат-список и часть списков [start, end), которую считает операция
+		ResList []float64 `json:"res_list,omitempty"`
+		Slice   []int64   `json:"slice,omitempty"`
+		// у свёртки по диапазону: тело и имена значений в нём
+		Body   string   `json:"body,omitempty"`
+		Params []string `json:"params,omitempty"`
+	}
+	graphEdge struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+		Arg  int64 `json:"arg"`
+	}
+	// graphGuard - операция (или её аргумент arg) нужна, только если условие
+	// from выбрало ветку branch; arg == -1 - вся операция
+	graphGuard struct {
+		From   int64 `json:"from"`
+		To     int64 `json:"to"`
+		Branch bool  `json:"branch"`
+		Arg    int64 `json:"arg"`
+	}
+	graphResponse struct {
+		ExprId int64        `json:"expression_id"`
+		Expr   string       `json:"expr"`
+		State  string       `json:"state"`
+		Nodes  []graphNode  `json:"nodes"`
+		Edges  []graphEdge  `json:"edges"`
+		Guards []graphGuard `json:"guards"`
+	}
+)
+
+// цвет узла в DOT по состоянию операции
+var stateColors = map[string]string{
+	"calculated":    "palegreen",
+	"ready_to_calc": "gold",
+	"created":       "gold",
+	"waiting":       "lightgrey",
+	"skipped":       "white",
+	"failed":        "salmon",
+}
+
+func buildGraph(expr db.Expression, opers []db.Operation, edges []db.Edge, guards []db.Guard) graphResponse {
+	g := graphResponse{
+		ExprId: expr.Id,
+		Expr:   expr.Expr,
+		State:  expr.State,
+		Nodes:  []graphNode{},
+		Edges:  []graphEdge{},
+		Guards: []graphGuard{},
+	}
+	for _, o := range opers {
+		node := graphNode{
+			Id:      o.Id,
+			Oper:    o.Oper,
+			Args:    []graphOperand{},
+			State:   o.State,
+			Final:   o.Final == 1,
+			ResList: o.ResList,
+			Body:    o.Body,
+			Params:  o.Params,
+		}
+		if o.End > 0 {
+			node.Slice = []int64{o.Start, o.End}
+		}
+		for _, arg := range o.Args {
+			operand := graphOperand{Ready: arg.Ready, List: arg.List}
+			if arg.Ready && arg.List == nil {
+				operand.Value = &arg.Value
+			}
+			node.Args = append(node.Args, operand)
+		}
+		if o.Res.Valid {
+			node.Res = &o.Res.Float64
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	for _, e := range edges {
+		g.Edges = append(g.Edges, graphEdge{From: e.From, To: e.To, Arg: e.Arg})
+	}
+	for _, guard := range guards {
+		g.Guards = append(g.Guards, graphGuard{From: guard.Condition, To: guard.Oper, Branch: guard.Branch, Arg: guard.Arg})
+	}
+	return g
+}
+
+func formatNumber(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// formatList показывает в DOT короткий список целиком, а длинный - только длину
+func formatList(list []float64) string {
+	if len(list) > 5 {
+		return fmt.Sprintf("[%d items]", len(list))
+	}
+	items := make([]string, len(list))
+	for i, x := range list {
+		items[i] = formatNumber(x)
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func (g graphResponse) dot() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph expr_%d {\n", g.ExprId)
+	fmt.Fprintf(&b, "\tlabel=%q;\n", g.Expr+" ("+g.State+")")
+	b.WriteString("\tnode [shape=box, style=filled];\n")
+	for _, n := range g.Nodes {
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = "?"
+			if arg.Value != nil {
+				args[i] = formatNumber(*arg.Value)
+			}
+			if arg.List != nil {
+				args[i] = formatList(arg.List)
+			}
+		}
+		oper := n.Oper
+		if n.Slice != nil {
+			oper += fmt.Sprintf("[%d:%d]", n.Slice[0], n.Slice[1])
+		}
+		label := fmt.Sprintf("#%d %s(%s)", n.Id, oper, strings.Join(args, ", "))
+		if n.Body != "" {
+			label += fmt.Sprintf("\n(%s) -> %s", strings.Join(n.Params, ", "), n.Body)
+		}
+		label += "\n" + n.State
+		if n.Res != nil {
+			label += " = " + formatNumber(*n.Res)
+		}
+		if n.ResList != nil {
+			label += " = " + formatList(n.ResList)
+		}
+		color, ok := stateColors[n.State]
+		if !ok {
+			color = "white"
+		}
+		fmt.Fprintf(&b, "\top%d [label=%q, fillcolor=%s];\n", n.Id, label, color)
+		if n.Final {
+			fmt.Fprintf(&b, "\top%d -> result;\n", n.Id)
+		}
+	}
+	nodes := map[int64]bool{}
+	for _, n := range g.Nodes {
+		nodes[n.Id] = true
+	}
+	for _, e := range g.Edges {
+		if !nodes[e.From] {
+			// результат операции другого выражения, на которое ссылается это
+			nodes[e.From] = true
+			fmt.Fprintf(&b, "\top%d [label=\"#%d\", style=dashed];\n", e.From, e.From)
+		}
+		fmt.Fprintf(&b, "\top%d -> op%d [label=\"arg %d\"];\n", e.From, e.To, e.Arg)
+	}
+	for _, guard := range g.Guards {
+		label := "else"
+		if guard.Branch {
+			label = "then"
+		}
+		if guard.Arg >= 0 {
+			label += fmt.Sprintf(" arg %d", guard.Arg)
+		}
+		fmt.Fprintf(&b, "\top%d -> op%d [label=%q, style=dashed];\n", guard.From, guard.To, label)
+	}
+	b.WriteString("\tresult [shape=doublecircle, style=solid];\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeGraph отдаёт граф операций выражения в формате DOT (по умолчанию) или JSON.
+func writeGraph(ctx context.Context, w http.ResponseWriter, format string, expr db.Expression) {
+	opers, err := db.SelectOperationsByExprId(ctx, database, expr.Id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "some DataBase error", http.StatusInternalServerError)
+		return
+	}
+	edges, err := db.SelectEdgesByExprId(ctx, database, expr.Id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "some DataBase error", http.StatusInternalServerError)
+		return
+	}
+	guards, err := db.SelectGuardsByExprId(ctx, database, expr.Id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "some DataBase error", http.StatusInternalServerError)
+		return
+	}
+	g := buildGraph(expr, opers, edges, guards)
+
+	switch format {
+	case "", "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		_, err = w.Write([]byte(g.dot()))
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(g)
+	default:
+		http.Error(w, "Invalid format, expected dot or json", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
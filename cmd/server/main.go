@@ -4,6 +4,7 @@ import (
 	"context"
 	sql "database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -22,8 +23,9 @@ import (
 
 const hmacSampleSecret = "super_secret_signature"
 
-func expressionHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.TODO()
+// requestClaims достаёт claims из токена в куке или заголовке auth-token,
+// сам токен уже проверен в authMiddleware
+func requestClaims(r *http.Request) jwt.MapClaims {
 	c, err := r.Cookie("token")
 	var tokenString string
 	if err != nil {
@@ -39,9 +41,21 @@ func expressionHandler(w http.ResponseWriter, r *http.Request) {
 		return []byte(hmacSampleSecret), nil
 	})
 	claims, _ := tokenFromString.Claims.(jwt.MapClaims)
+	return claims
+}
+
+func expressionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+	claims := requestClaims(r)
+
+	if r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/expr" {
+		searchExpressions(w, r, int64(claims["userId"].(float64)))
+		return
+	}
 
 	if r.Method == http.MethodGet {
 		exprIdStr := strings.TrimPrefix(r.URL.Path, "/expr/")
+		exprIdStr, graph := strings.CutSuffix(exprIdStr, "/graph")
 		exprId, err := strconv.ParseInt(exprIdStr, 10, 64)
 		if err != nil {
 			http.Error(w, "Invalid expr_id", http.StatusBadRequest)
@@ -58,7 +72,34 @@ func expressionHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "no access", http.StatusForbidden)
 			return
 		}
-		jsonData, err := json.Marshal(expr)
+		expr.Folds, err = db.SelectFoldsByExprId(ctx, database, exprId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "some DataBase error", http.StatusInternalServerError)
+			return
+		}
+		expr.Values, err = db.SelectValuesByExprId(ctx, database, exprId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "some DataBase error", http.StatusInternalServerError)
+			return
+		}
+		if graph {
+			writeGraph(ctx, w, r.URL.Query().Get("format"), expr)
+			return
+		}
+		var resp any = expr
+		if explain, _ := strconv.ParseBool(r.URL.Query().Get("explain")); explain {
+			// по шагам: какие операции, в каком порядке и где были посчитаны
+			opers, err := db.SelectOperationsTrace(ctx, database, exprId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "some DataBase error", http.StatusInternalServerError)
+				return
+			}
+			resp = explainResponse{Expression: expr, Trace: buildTrace(opers)}
+		}
+		jsonData, err := json.Marshal(resp)
 		if err != nil {
 			fmt.Println(err)
 			http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
@@ -80,13 +121,16 @@ func expressionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var expr string
-		err = json.NewDecoder(r.Body).Decode(&expr)
+		req, err := decodeExprRequest(r)
 		if err != nil {
 			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 			return
 		}
-		exprID, readyOperIDs := parser.BuildOperations(expr, int64(claims["userId"].(float64)))
+		exprID, readyOperIDs, err := parser.BuildOperations(req.Expression, req.Vars, int64(claims["userId"].(float64)), req.Options)
+		if err != nil {
+			writeParseError(w, err)
+			return
+		}
 		for _, operId := range readyOperIDs {
 			go func() {
 				o, _ := db.SelectOperationById(ctx, database, operId)
@@ -99,6 +143,244 @@ func expressionHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// searchExpressions отдаёт выражения пользователя. С параметром q - только те,
+// в которых q встречается целыми токенами, см. parser.MatchCanonical; если q -
+// правильное выражение, оно сравнивается в канонической записи, поэтому "2*3"
+// найдёт "1 + 2 * 3", но не "12 * 34".
+func searchExpressions(w http.ResponseWriter, r *http.Request, userId int64) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if script, err := parser.ParseScript(q); err == nil {
+		q = parser.FormatScript(script)
+	}
+	found, err := db.SearchExpressions(context.TODO(), database, userId, q)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "some DataBase error", http.StatusInternalServerError)
+		return
+	}
+	exprs := []db.Expression{}
+	for _, e := range found {
+		if parser.MatchCanonical(e.Canonical, q) {
+			exprs = append(exprs, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(exprs)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// formatHandler возвращает выражение в канонической записи, ничего не сохраняя.
+func formatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeExprRequest(r)
+	if err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	script, err := parser.ParseScript(req.Expression)
+	if err != nil {
+		writeParseError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{"canonical": parser.FormatScript(script)})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+type exprRequest struct {
+	Expression string             `json:"expression"`
+	Vars       map[string]float64 `json:"vars"`
+	parser.Options
+}
+
+// decodeExprRequest принимает и просто строку с выражением,
+// и объект {"expression": ..., "vars": {...}, <настройки parser.Options>}
+func decodeExprRequest(r *http.Request) (exprRequest, error) {
+	req := exprRequest{Options: parser.DefaultOptions}
+	var body json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return req, err
+	}
+	if len(body) > 0 && body[0] == '"' {
+		err = json.Unmarshal(body, &req.Expression)
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	return req, err
+}
+
+func writeParseError(w http.ResponseWriter, err error) {
+	var syntaxErr *parser.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(syntaxErr)
+		return
+	}
+	var unboundErr *parser.UnboundError
+	if errors.As(err, &unboundErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(unboundErr)
+		return
+	}
+	var planErr *parser.PlanError
+	if errors.As(err, &planErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(planErr)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+type (
+	plannedArg struct {
+		Value *float64 `json:"value,omitempty"`
+		From  *int     `json:"from,omitempty"`
+		// id операции другого выражения, результата которой ждёт аргумент
+		External *int64 `json:"external,omitempty"`
+		// готовый список
+		List []float64 `json:"list,omitempty"`
+	}
+	plannedLink struct {
+		OperationId int `json:"operation_id"`
+		Arg         int `json:"arg"`
+	}
+	plannedName struct {
+		Name string `json:"name"`
+		plannedArg
+	}
+	// plannedGuard - операция (или её аргумент arg) нужна, только если
+	// условие operation_id выбрало ветку then; arg == -1 - вся операция
+	plannedGuard struct {
+		OperationId int  `json:"operation_id"`
+		Then        bool `json:"then"`
+		Arg         int  `json:"arg"`
+	}
+	plannedOperation struct {
+		Id     int            `json:"id"`
+		Oper   string         `json:"oper"`
+		Args   []plannedArg   `json:"args"`
+		Notify []plannedLink  `json:"notify"`
+		Guards []plannedGuard `json:"guards,omitempty"`
+		Final  bool           `json:"final"`
+		Ready  bool           `json:"ready"`
+		Depth  int            `json:"depth"`
+		// длина списка-результата и часть списков [start, end), которую считает операция
+		Length int   `json:"length,omitempty"`
+		Slice  []int `json:"slice,omitempty"`
+		// у свёртки по диапазону: тело и имена значений в нём
+		Body   string   `json:"body,omitempty"`
+		Params []string `json:"params,omitempty"`
+	}
+	planResponse struct {
+		Operations []plannedOperation `json:"operations"`
+		Ready      []int              `json:"ready"`
+		Depth      int                `json:"depth"`
+		Result     *float64           `json:"result,omitempty"`
+		ResultList []float64          `json:"result_list,omitempty"`
+		Names      []plannedName      `json:"names,omitempty"`
+		Folds      []db.Fold          `json:"folds,omitempty"`
+	}
+)
+
+func newPlannedArg(arg parser.PlannedArg) plannedArg {
+	if arg.IsLiteral() && arg.List != nil {
+		return plannedArg{List: arg.List}
+	}
+	if arg.IsLiteral() {
+		return plannedArg{Value: &arg.Value}
+	}
+	if arg.IsExternal() {
+		return plannedArg{External: &arg.External}
+	}
+	return plannedArg{From: &arg.From}
+}
+
+// planHandler разбивает выражение на операции, но ничего не сохраняет и не вычисляет.
+// id операций в ответе - их номера в плане.
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeExprRequest(r)
+	if err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	userId := int64(requestClaims(r)["userId"].(float64))
+	built, err := parser.BuildPlan(context.TODO(), database, req.Expression, req.Vars, userId, req.Options)
+	if err != nil {
+		writeParseError(w, err)
+		return
+	}
+	plan, folds := built.Plan, built.Folds
+
+	resp := planResponse{
+		Operations: []plannedOperation{},
+		Ready:      []int{},
+		Depth:      plan.Depth(),
+		Folds:      folds,
+	}
+	if plan.Result.IsLiteral() && plan.Result.List != nil {
+		resp.ResultList = plan.Result.List
+	} else if plan.Result.IsLiteral() {
+		resp.Result = &plan.Result.Value
+	}
+	for _, name := range plan.Names {
+		resp.Names = append(resp.Names, plannedName{Name: name.Name, plannedArg: newPlannedArg(name.Arg)})
+	}
+	depths := plan.Depths()
+	for i, o := range plan.Operations {
+		op := plannedOperation{
+			Id:     i,
+			Oper:   o.Oper,
+			Notify: []plannedLink{},
+			Final:  i == plan.Result.From,
+			Ready:  o.Ready(),
+			Depth:  depths[i],
+			Length: o.Len,
+			Body:   o.Body,
+			Params: o.Params,
+		}
+		if o.End > 0 {
+			op.Slice = []int{o.Start, o.End}
+		}
+		for _, arg := range o.Args {
+			op.Args = append(op.Args, newPlannedArg(arg))
+		}
+		for _, c := range o.Consumers {
+			op.Notify = append(op.Notify, plannedLink{OperationId: c.Operation, Arg: c.Arg})
+		}
+		for _, g := range o.Guards {
+			op.Guards = append(op.Guards, plannedGuard{OperationId: g.Operation, Then: g.Then, Arg: g.Arg})
+		}
+		if op.Ready {
+			resp.Ready = append(resp.Ready, i)
+		}
+		resp.Operations = append(resp.Operations, op)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -217,6 +499,15 @@ func main() {
 	}
 	x, _ := strconv.Atoi(os.Getenv("AGENTS_CNT"))
 	utils.Port.SetCnt(x)
+	if chunk, err := strconv.Atoi(os.Getenv("LIST_CHUNK")); err == nil && chunk > 0 {
+		parser.ListChunk = chunk
+	}
+	if chunk, err := strconv.Atoi(os.Getenv("RANGE_CHUNK")); err == nil && chunk > 0 {
+		parser.RangeChunk = chunk
+	}
+	if limit, err := strconv.ParseInt(os.Getenv("RANGE_MAX"), 10, 64); err == nil && limit > 0 {
+		parser.RangeMax = limit
+	}
 
 	database, err = sql.Open("sqlite3", "./db/expressions.db")
 	if err != nil {
@@ -229,9 +520,10 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	_ = db.CreateUsersTable(ctx, database)
-	_ = db.CreateExpressionsTable(ctx, database)
-	_ = db.CreateOpersTable(ctx, database)
+	err = db.Migrate(ctx, database)
+	if err != nil {
+		panic(err)
+	}
 
 	ready, _ := db.SelectOperationsToCalc(ctx, database)
 	for _, oper := range ready {
@@ -239,10 +531,29 @@ func main() {
 			parser.SendTask(ctx, database, oper)
 		}()
 	}
+	undelivered, _ := db.SelectUndeliveredEdges(ctx, database)
+	for _, e := range undelivered {
+		sender, err := db.SelectOperationById(ctx, database, e.From)
+		if err != nil {
+			panic(err)
+		}
+		parser.DeliverResult(ctx, database, e, sender.Res.Float64, sender.ExactRes.String, sender.ResList)
+	}
+	unresolved, _ := db.SelectUnresolvedGuards(ctx, database)
+	for _, g := range unresolved {
+		cond, err := db.SelectOperationById(ctx, database, g.Condition)
+		if err != nil {
+			panic(err)
+		}
+		parser.ResolveGuard(ctx, database, g, cond.Res.Float64 != 0)
+	}
 	fmt.Println("Ready! Listening on 8080")
 	//
 	http.HandleFunc("/expr/", authMiddleware(expressionHandler))
 	http.HandleFunc("/expr", authMiddleware(expressionHandler))
+	http.HandleFunc("/expr/plan", authMiddleware(planHandler))
+	http.HandleFunc("/expr/format", authMiddleware(formatHandler))
+	http.HandleFunc("/functions", authMiddleware(functionsHandler))
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/register", registerHandler)
 
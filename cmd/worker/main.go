@@ -4,14 +4,19 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+	parser "github.com/Zheleznov-Fedor/new-ya-long-calc/expr_parser"
 	pb "github.com/Zheleznov-Fedor/new-ya-long-calc/proto"
 	"github.com/joho/godotenv"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
@@ -22,42 +27,188 @@ func NewServer() *Server {
 	return &Server{}
 }
 
+// ServerV2 - та же операция, но числа передаются в double
+type ServerV2 struct {
+	pb.UnimplementedOperationServiceV2Server
+}
+
+func NewServerV2() *ServerV2 {
+	return &ServerV2{}
+}
+
 func (s *Server) Calc(
 	ctx context.Context,
 	in *pb.OperationRequest,
 ) (*pb.OperationResult, error) {
 	log.Println("request: ", in)
-	var n int
-	var res float32
-
-	switch in.Oper {
-	case "+":
-		n, _ = strconv.Atoi(os.Getenv("TIME_ADD"))
-		res = in.A + in.B
-		break
-	case "-":
-		n, _ = strconv.Atoi(os.Getenv("TIME_SUBSTR"))
-		res = in.A - in.B
-	case "*":
-		n, _ = strconv.Atoi(os.Getenv("TIME_MULT"))
-		res = in.A * in.B
-	case "/":
-		n, _ = strconv.Atoi(os.Getenv("TIME_DIVISION"))
-		res = in.A / in.B
-	}
 
-	time.Sleep(time.Duration(n) * time.Second)
+	args := make([]float64, 0, len(in.Args))
+	for _, arg := range in.Args {
+		args = append(args, float64(arg))
+	}
+	// запрос от оркестратора, который не знает про args
+	if len(args) == 0 {
+		args = []float64{float64(in.A), float64(in.B)}
+	}
+	res, exact, err := calculate(in.Oper, args, in.ExactArgs)
+	if err != nil {
+		return nil, err
+	}
 
 	return &pb.OperationResult{
-		Result: res,
+		Result:      float32(res),
+		ExactResult: exact,
+	}, nil
+}
+
+func (s *ServerV2) Calc(
+	ctx context.Context,
+	in *pb.OperationRequestV2,
+) (*pb.OperationResultV2, error) {
+	log.Println("request v2: ", in)
+
+	if _, ok := calc.RangeOperations[in.Oper]; ok {
+		res, err := calculateRange(in.Oper, in.Args, in.Body, in.Params)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.OperationResultV2{Result: res}, nil
+	}
+	if _, ok := calc.ListOperations[in.Oper]; ok || len(in.Lists) > 0 {
+		res, err := calculateList(in.Oper, in.Args, in.Lists)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.OperationResultV2{Result: res.Number, ListResult: res.List}, nil
+	}
+	res, exact, err := calculate(in.Oper, in.Args, in.ExactArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.OperationResultV2{
+		Result:      res,
+		ExactResult: exact,
 	}, nil
 }
 
+// calculate выполняет операцию и ждёт заданное для неё время.
+// Второй результат - точное значение, если аргументы переданы точно.
+func calculate(oper string, args []float64, exactArgs []string) (float64, string, error) {
+	op, ok := calc.Operations[oper]
+	if !ok {
+		return 0, "", status.Errorf(codes.InvalidArgument, "unknown operation %s", oper)
+	}
+	if len(args) < op.MinArgs {
+		return 0, "", status.Errorf(codes.InvalidArgument, "operation %s: not enough arguments", oper)
+	}
+
+	n, _ := strconv.Atoi(os.Getenv(op.TimeEnv))
+	res := op.Calc(args)
+	exact := ""
+	if exactRes, ok := calcExact(oper, exactArgs); ok {
+		exact = calc.FormatExact(exactRes)
+		res, _ = exactRes.Float64()
+	}
+
+	time.Sleep(time.Duration(n) * time.Second)
+
+	return res, exact, nil
+}
+
+// calculateList выполняет операцию, среди аргументов или результата которой есть списки.
+// Операции из calc.Operations выполняются поэлементно; точного результата у списков нет.
+func calculateList(oper string, args []float64, lists []*pb.ListArg) (calc.Value, error) {
+	if len(lists) > 0 && len(lists) != len(args) {
+		return calc.Value{}, status.Errorf(codes.InvalidArgument, "operation %s: lists do not match args", oper)
+	}
+	values := make([]calc.Value, len(args))
+	for i, arg := range args {
+		values[i].Number = arg
+		if len(lists) > 0 && len(lists[i].Values) > 0 {
+			values[i].List = lists[i].Values
+		}
+	}
+
+	var timeEnv string
+	var res calc.Value
+	var err error
+	if op, ok := calc.ListOperations[oper]; ok {
+		if len(values) < op.MinArgs {
+			return calc.Value{}, status.Errorf(codes.InvalidArgument, "operation %s: not enough arguments", oper)
+		}
+		timeEnv = op.TimeEnv
+		res, err = op.Calc(values)
+	} else if op, ok := calc.Operations[oper]; ok {
+		if len(values) < op.MinArgs {
+			return calc.Value{}, status.Errorf(codes.InvalidArgument, "operation %s: not enough arguments", oper)
+		}
+		timeEnv = op.TimeEnv
+		res, err = calc.Elementwise(op, values)
+	} else {
+		return calc.Value{}, status.Errorf(codes.InvalidArgument, "unknown operation %s", oper)
+	}
+	if err != nil {
+		return calc.Value{}, status.Errorf(codes.InvalidArgument, "operation %s: %v", oper, err)
+	}
+
+	n, _ := strconv.Atoi(os.Getenv(timeEnv))
+	time.Sleep(time.Duration(n) * time.Second)
+
+	return res, nil
+}
+
+// calculateRange сворачивает body по индексу params[0] от args[0] до args[1];
+// остальные имена из params получают значения args[2:]. Время операции
+// ждётся один раз на всю часть диапазона.
+func calculateRange(oper string, args []float64, body string, params []string) (float64, error) {
+	if len(params) == 0 || len(args) != len(params)+1 {
+		return 0, status.Errorf(codes.InvalidArgument, "operation %s: params do not match args", oper)
+	}
+	node, err := parser.Parse(body)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "operation %s: %v", oper, err)
+	}
+	env := map[string]float64{}
+	for i, name := range params[1:] {
+		env[name] = args[i+2]
+	}
+	res, err := parser.EvaluateRange(oper, params[0], args[0], args[1], node, env)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "operation %s: %v", oper, err)
+	}
+
+	n, _ := strconv.Atoi(os.Getenv(calc.RangeOperations[oper].TimeEnv))
+	time.Sleep(time.Duration(n) * time.Second)
+
+	return res, nil
+}
+
+// calcExact считает операцию над точными аргументами,
+// если они переданы и результат можно записать точно
+func calcExact(oper string, exactArgs []string) (*big.Rat, bool) {
+	f, ok := calc.ExactOperations[oper]
+	if !ok || len(exactArgs) < calc.Operations[oper].MinArgs {
+		return nil, false
+	}
+	args := make([]*big.Rat, len(exactArgs))
+	for i, arg := range exactArgs {
+		args[i], ok = calc.ParseExact(arg)
+		if !ok {
+			return nil, false
+		}
+	}
+	return f(args)
+}
+
 func main() {
 	err := godotenv.Load(".env")
 	if err != nil {
 		fmt.Println("Error loading .env file")
 	}
+	if limit, err := strconv.ParseInt(os.Getenv("RANGE_MAX"), 10, 64); err == nil && limit > 0 {
+		parser.RangeMax = limit
+	}
 	host := "localhost"
 	port := os.Args[1]
 
@@ -77,6 +228,7 @@ func main() {
 	geomServiceServer := NewServer()
 	// зарегистрируем нашу реализацию сервера
 	pb.RegisterOperationServiceServer(grpcServer, geomServiceServer)
+	pb.RegisterOperationServiceV2Server(grpcServer, NewServerV2())
 	// запустим grpc сервер
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Println("error serving grpc: ", err)
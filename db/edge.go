@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// Edge - результат операции From становится аргументом Arg операции To
+	Edge struct {
+		From int64
+		To   int64
+		Arg  int64
+	}
+)
+
+const (
+	edgesTable = `
+		CREATE TABLE "operation_edges" (
+			"from_operation_id"	INTEGER NOT NULL,
+			"to_operation_id"	INTEGER NOT NULL,
+			"arg"	INTEGER NOT NULL,
+			FOREIGN KEY("from_operation_id") REFERENCES "operations"("id"),
+			FOREIGN KEY("to_operation_id") REFERENCES "operations"("id"),
+			PRIMARY KEY("to_operation_id", "arg")
+		);`
+)
+
+func CreateEdgesTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, edgesTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func InsertEdge(ctx context.Context, db Querier, e Edge) error {
+	var q = `
+	INSERT INTO operation_edges (from_operation_id, to_operation_id, arg) values ($1, $2, $3)
+	`
+	_, err := db.ExecContext(ctx, q, e.From, e.To, e.Arg)
+	return err
+}
+
+func selectEdges(ctx context.Context, db *sql.DB, q string, args ...any) ([]Edge, error) {
+	var edges []Edge
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := Edge{}
+		err := rows.Scan(&e.From, &e.To, &e.Arg)
+		if err != nil {
+			return nil, err
+		}
+		edges = append(edges, e)
+	}
+	return edges, rows.Err()
+}
+
+// SelectEdgesFrom возвращает всех получателей результата операции.
+func SelectEdgesFrom(ctx context.Context, db *sql.DB, id int64) ([]Edge, error) {
+	var q = `SELECT from_operation_id, to_operation_id, arg FROM operation_edges
+	WHERE from_operation_id = $1 ORDER BY to_operation_id, arg`
+	return selectEdges(ctx, db, q, id)
+}
+
+func SelectEdgesByExprId(ctx context.Context, db *sql.DB, exprId int64) ([]Edge, error) {
+	var q = `SELECT e.from_operation_id, e.to_operation_id, e.arg FROM operation_edges e
+	JOIN operations o ON o.id = e.to_operation_id
+	WHERE o.expression_id = $1 ORDER BY e.from_operation_id, e.to_operation_id, e.arg`
+	return selectEdges(ctx, db, q, exprId)
+}
+
+// SelectUndeliveredEdges возвращает рёбра, по которым результат уже посчитан,
+// но до получателя так и не дошёл - например, сервер остановился посреди рассылки.
+func SelectUndeliveredEdges(ctx context.Context, db *sql.DB) ([]Edge, error) {
+	var q = `SELECT e.from_operation_id, e.to_operation_id, e.arg FROM operation_edges e
+	JOIN operations o ON o.id = e.from_operation_id
+	JOIN operands a ON a.operation_id = e.to_operation_id AND a.position = e.arg
+	WHERE o.state = 'calculated' AND a.ready = 0`
+	return selectEdges(ctx, db, q)
+}
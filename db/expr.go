@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"strconv"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -16,12 +17,33 @@ type (
 		Res        sql.NullFloat64 `json:"res"`
 		State      string          `json:"state"`
 		ReadyOpers int64           `json:"ready_opers"`
+		// выражение считается точно, см. ExactRes
+		Exact bool `json:"exact,omitempty"`
+		// точный результат: десятичная дробь или "p/q"
+		ExactRes sql.NullString `json:"exact_res"`
+		// значения переменных, с которыми выражение было отправлено
+		Vars map[string]float64 `json:"vars,omitempty"`
+		// значения, присвоенные именам в скрипте
+		Values []Value `json:"values,omitempty"`
+		Folds  []Fold  `json:"folds,omitempty"`
+		// выражение в каноническом виде, см. parser.FormatScript
+		Canonical string `json:"canonical"`
+		// результат-список, тогда Res не заполнен
+		ResList []float64 `json:"res_list,omitempty"`
+		// настройки оптимизации, с которыми строился граф, см. parser.Options;
+		// у выражений, сохранённых до появления колонок, неизвестны
+		Simplify      bool `json:"simplify"`
+		FoldConstants bool `json:"fold_constants"`
+		Rebalance     bool `json:"rebalance"`
+		// почему выражение не посчитано, когда state = failed
+		Error string `json:"error,omitempty"`
 	}
 )
 
-func CreateExpressionsTable(ctx context.Context, db *sql.DB) error {
-	const (
-		expressionsTable = `
+const expressionColumns = "id, expr, res, state, ready_opers, user_id, vars, exact, exact_res, canonical, res_list, simplify, fold_constants, rebalance, error"
+
+const (
+	expressionsTable = `
 		CREATE TABLE "expressions" (
 			"id"	INTEGER NOT NULL,
 			"expr"	TEXT NOT NULL,
@@ -29,14 +51,28 @@ func CreateExpressionsTable(ctx context.Context, db *sql.DB) error {
 			"state"	TEXT NOT NULL,
 			"ready_opers"	INTEGER NOT NULL DEFAULT 0,
 			"user_id"	INTEGER NOT NULL,
+			"vars"	TEXT,
+			"exact"	INTEGER NOT NULL DEFAULT 0,
+			"exact_res"	TEXT,
+			"canonical"	TEXT NOT NULL DEFAULT '',
+			"res_list"	TEXT,
+			"simplify"	INTEGER,
+			"fold_constants"	INTEGER,
+			"rebalance"	INTEGER,
+			"error"	TEXT,
 			PRIMARY KEY("id" AUTOINCREMENT),
 			FOREIGN KEY("user_id") REFERENCES "users"("id")
 		);`
-	)
+	canonicalIndex = `CREATE INDEX IF NOT EXISTS "expressions_canonical" ON "expressions" ("user_id", "canonical");`
+)
 
+func CreateExpressionsTable(ctx context.Context, db *sql.DB) error {
 	if _, err := db.ExecContext(ctx, expressionsTable); err != nil {
 		return err
 	}
+	if _, err := db.ExecContext(ctx, canonicalIndex); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -47,11 +83,29 @@ func (e Expression) Print() string {
 	return "Id: " + id + " Expression: " + e.Expr + " State:" + e.State + " Res:" + Res
 }
 
-func InsertExpression(ctx context.Context, db *sql.DB, expression *Expression) (int64, error) {
+// значения переменных хранятся в JSON, ключи в нём отсортированы
+func marshalVars(vars map[string]float64) (sql.NullString, error) {
+	if len(vars) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func InsertExpression(ctx context.Context, db Querier, expression *Expression) (int64, error) {
 	var q = `
-	INSERT INTO expressions (expr, state, user_id) values ($1, $2, $3)
+	INSERT INTO expressions (expr, state, user_id, vars, exact, canonical, simplify, fold_constants, rebalance)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
-	result, err := db.ExecContext(ctx, q, expression.Expr, expression.State, expression.UserId)
+	vars, err := marshalVars(expression.Vars)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.ExecContext(ctx, q, expression.Expr, expression.State, expression.UserId, vars, expression.Exact, expression.Canonical,
+		expression.Simplify, expression.FoldConstants, expression.Rebalance)
 	if err != nil {
 		return 0, err
 	}
@@ -63,26 +117,67 @@ func InsertExpression(ctx context.Context, db *sql.DB, expression *Expression) (
 	return id, nil
 }
 
+func scanExpression(row scanner) (Expression, error) {
+	e := Expression{}
+	var vars, resList sql.NullString
+	var simplify, foldConstants, rebalance sql.NullBool
+	var failure sql.NullString
+	err := row.Scan(&e.Id, &e.Expr, &e.Res, &e.State, &e.ReadyOpers, &e.UserId, &vars, &e.Exact, &e.ExactRes, &e.Canonical, &resList,
+		&simplify, &foldConstants, &rebalance, &failure)
+	if err != nil {
+		return e, err
+	}
+	e.Error = failure.String
+	e.Simplify, e.FoldConstants, e.Rebalance = simplify.Bool, foldConstants.Bool, rebalance.Bool
+	e.ResList, err = ParseList(resList)
+	if err != nil || !vars.Valid {
+		return e, err
+	}
+	err = json.Unmarshal([]byte(vars.String), &e.Vars)
+	return e, err
+}
+
 func SelectExpressions(ctx context.Context, db *sql.DB) ([]Expression, error) {
-	var expressions []Expression
-	var q = "SELECT * FROM expressions"
+	return selectExpressions(ctx, db, "SELECT "+expressionColumns+" FROM expressions")
+}
 
-	rows, err := db.QueryContext(ctx, q)
+// SearchExpressions возвращает выражения пользователя, в канонической записи
+// которых есть подстрока canonical; пустая строка подходит ко всем. Совпадение
+// по подстроке может оказаться внутри числа или имени, его надо проверить.
+func SearchExpressions(ctx context.Context, db *sql.DB, userId int64, canonical string) ([]Expression, error) {
+	var q = "SELECT " + expressionColumns + " FROM expressions WHERE user_id = $1 AND instr(canonical, $2) > 0 ORDER BY id"
+	return selectExpressions(ctx, db, q, userId, canonical)
+}
+
+// SelectDuplicateExpression ищет у того же пользователя выражение с той же
+// канонической записью, переменными, режимом вычисления и настройками
+// оптимизации: от них зависят порядок округлений и граф операций.
+// Выражения, которые не удалось посчитать, не подходят.
+func SelectDuplicateExpression(ctx context.Context, db *sql.DB, e Expression) (Expression, error) {
+	vars, err := marshalVars(e.Vars)
+	if err != nil {
+		return Expression{}, err
+	}
+	var q = "SELECT " + expressionColumns + ` FROM expressions
+	WHERE user_id = $1 AND canonical = $2 AND vars IS $3 AND exact = $4
+		AND simplify = $5 AND fold_constants = $6 AND rebalance = $7 AND state != 'failed' ORDER BY id LIMIT 1`
+	return scanExpression(db.QueryRowContext(ctx, q, e.UserId, e.Canonical, vars, e.Exact,
+		e.Simplify, e.FoldConstants, e.Rebalance))
+}
+
+func selectExpressions(ctx context.Context, db *sql.DB, q string, args ...any) ([]Expression, error) {
+	var expressions []Expression
+	rows, err := db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		e := Expression{}
-		var res sql.NullFloat64
-		err := rows.Scan(&e.Id, &e.Expr, &res, &e.State, &e.ReadyOpers, &e.UserId)
+		e, err := scanExpression(rows)
 		if err != nil {
 			return nil, err
 		}
-		if res.Valid {
-			e.Res = res
-		}
 		expressions = append(expressions, e)
 	}
 
@@ -90,18 +185,28 @@ func SelectExpressions(ctx context.Context, db *sql.DB) ([]Expression, error) {
 }
 
 func SelectExpressionById(ctx context.Context, db *sql.DB, id int64) (Expression, error) {
-	e := Expression{}
-	var q = "SELECT * FROM expressions WHERE id = $1"
-	err := db.QueryRowContext(ctx, q, id).Scan(&e.Id, &e.Expr, &e.Res, &e.State, &e.ReadyOpers, &e.UserId)
+	var q = "SELECT " + expressionColumns + " FROM expressions WHERE id = $1"
+	return scanExpression(db.QueryRowContext(ctx, q, id))
+}
+
+// SetExpressionResult записывает результат выражения; exact - точный результат
+// или пустая строка, если его нет, list - результат-список или nil.
+func SetExpressionResult(ctx context.Context, db Querier, id int64, res float64, exact string, list []float64) error {
+	var q = "UPDATE expressions SET state = 'ready', res = $1, exact_res = NULLIF($2, ''), res_list = $3 WHERE id = $4"
+	// у результата-списка числа нет
+	number := sql.NullFloat64{Float64: res, Valid: list == nil}
+	_, err := db.ExecContext(ctx, q, number, exact, FormatList(list), id)
 	if err != nil {
-		return e, err
+		return err
 	}
-	return e, nil
+
+	return nil
 }
 
-func SetExpressionResult(ctx context.Context, db *sql.DB, id int64, res float64) error {
-	var q = "UPDATE expressions SET state = 'ready', res = $1 WHERE id = $2"
-	_, err := db.ExecContext(ctx, q, res, id)
+// SetExpressionFailed отмечает, что выражение не посчитать; msg - причина.
+func SetExpressionFailed(ctx context.Context, db Querier, id int64, msg string) error {
+	var q = "UPDATE expressions SET state = 'failed', error = $1 WHERE id = $2"
+	_, err := db.ExecContext(ctx, q, msg, id)
 	if err != nil {
 		return err
 	}
@@ -109,6 +214,29 @@ func SetExpressionResult(ctx context.Context, db *sql.DB, id int64, res float64)
 	return nil
 }
 
+// SelectDependentExpressions возвращает id выражений, которые ссылаются
+// на выражение id, то есть ждут результат одной из его операций.
+func SelectDependentExpressions(ctx context.Context, db *sql.DB, id int64) ([]int64, error) {
+	var q = `SELECT DISTINCT t.expression_id FROM operation_edges e
+	JOIN operations f ON f.id = e.from_operation_id
+	JOIN operations t ON t.id = e.to_operation_id
+	WHERE f.expression_id = $1 AND t.expression_id != $1 ORDER BY t.expression_id`
+	rows, err := db.QueryContext(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var dependent int64
+		if err := rows.Scan(&dependent); err != nil {
+			return nil, err
+		}
+		ids = append(ids, dependent)
+	}
+	return ids, rows.Err()
+}
+
 func ExprOperationCalculated(ctx context.Context, db *sql.DB, id int64) error {
 	var q = "UPDATE expressions SET ready_opers = ready_opers + 1 WHERE id = $1"
 	_, err := db.ExecContext(ctx, q, id)
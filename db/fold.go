@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// Fold - замена, сделанная в выражении до отправки вычислителям
+	Fold struct {
+		Rule   string `json:"rule"`
+		Before string `json:"before"`
+		After  string `json:"after"`
+	}
+)
+
+const (
+	foldsTable = `
+		CREATE TABLE "folds" (
+			"id"	INTEGER NOT NULL,
+			"expression_id"	INTEGER NOT NULL,
+			"rule"	TEXT NOT NULL,
+			"before"	TEXT NOT NULL,
+			"after"	TEXT NOT NULL,
+			FOREIGN KEY("expression_id") REFERENCES "expressions"("id"),
+			PRIMARY KEY("id" AUTOINCREMENT)
+		);`
+)
+
+func CreateFoldsTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, foldsTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func InsertFold(ctx context.Context, db Querier, exprId int64, f Fold) error {
+	var q = `
+	INSERT INTO folds (expression_id, rule, before, after) values ($1, $2, $3, $4)
+	`
+	_, err := db.ExecContext(ctx, q, exprId, f.Rule, f.Before, f.After)
+	return err
+}
+
+func SelectFoldsByExprId(ctx context.Context, db *sql.DB, exprId int64) ([]Fold, error) {
+	var folds []Fold
+	var q = "SELECT rule, before, after FROM folds WHERE expression_id = $1 ORDER BY id"
+	rows, err := db.QueryContext(ctx, q, exprId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := Fold{}
+		err := rows.Scan(&f.Rule, &f.Before, &f.After)
+		if err != nil {
+			return nil, err
+		}
+		folds = append(folds, f)
+	}
+	return folds, rows.Err()
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// Function - функция, которую пользователь определил сам: vat(x) = x * 1.2.
+	// Body хранится в канонической записи.
+	Function struct {
+		Name   string   `json:"name"`
+		Params []string `json:"params"`
+		Body   string   `json:"body"`
+	}
+)
+
+const (
+	functionsTable = `
+		CREATE TABLE "functions" (
+			"user_id"	INTEGER NOT NULL,
+			"name"	TEXT NOT NULL,
+			"params"	TEXT NOT NULL,
+			"body"	TEXT NOT NULL,
+			FOREIGN KEY("user_id") REFERENCES "users"("id"),
+			PRIMARY KEY("user_id", "name")
+		);`
+)
+
+func CreateFunctionsTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, functionsTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SaveFunction добавляет функцию пользователя или заменяет одноимённую.
+func SaveFunction(ctx context.Context, db *sql.DB, userId int64, f Function) error {
+	var q = `
+	INSERT OR REPLACE INTO functions (user_id, name, params, body) values ($1, $2, $3, $4)
+	`
+	_, err := db.ExecContext(ctx, q, userId, f.Name, strings.Join(f.Params, ","), f.Body)
+	return err
+}
+
+func SelectFunctionsByUser(ctx context.Context, db *sql.DB, userId int64) ([]Function, error) {
+	var functions []Function
+	var q = "SELECT name, params, body FROM functions WHERE user_id = $1 ORDER BY name"
+	rows, err := db.QueryContext(ctx, q, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := Function{Params: []string{}}
+		var params string
+		err := rows.Scan(&f.Name, &params, &f.Body)
+		if err != nil {
+			return nil, err
+		}
+		if params != "" {
+			f.Params = strings.Split(params, ",")
+		}
+		functions = append(functions, f)
+	}
+	return functions, rows.Err()
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// Guard связывает операцию с условием, от которого зависит, нужна ли она.
+	// Arg == -1: операция стоит в ветке Branch и ждёт условие как ещё один
+	// аргумент, а если выбрана другая ветка - пропускается.
+	// Arg >= 0: аргумент Arg операции выбора ветки приходит из ветки Branch;
+	// если выбрана другая ветка, он так и не придёт и заполняется нулём.
+	Guard struct {
+		Condition int64
+		Oper      int64
+		Branch    bool
+		Arg       int64
+	}
+)
+
+const (
+	guardsTable = `
+		CREATE TABLE "operation_guards" (
+			"condition_operation_id"	INTEGER NOT NULL,
+			"operation_id"	INTEGER NOT NULL,
+			"branch"	INTEGER NOT NULL,
+			"arg"	INTEGER NOT NULL,
+			"resolved"	INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY("condition_operation_id") REFERENCES "operations"("id"),
+			FOREIGN KEY("operation_id") REFERENCES "operations"("id"),
+			PRIMARY KEY("condition_operation_id", "operation_id", "arg")
+		);`
+)
+
+func CreateGuardsTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, guardsTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func InsertGuard(ctx context.Context, db Querier, g Guard) error {
+	var q = `
+	INSERT INTO operation_guards (condition_operation_id, operation_id, branch, arg) values ($1, $2, $3, $4)
+	`
+	_, err := db.ExecContext(ctx, q, g.Condition, g.Oper, g.Branch, g.Arg)
+	return err
+}
+
+func selectGuards(ctx context.Context, db *sql.DB, q string, args ...any) ([]Guard, error) {
+	var guards []Guard
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		g := Guard{}
+		err := rows.Scan(&g.Condition, &g.Oper, &g.Branch, &g.Arg)
+		if err != nil {
+			return nil, err
+		}
+		guards = append(guards, g)
+	}
+	return guards, rows.Err()
+}
+
+// SelectGuardsByCondition возвращает всё, что зависит от результата условия.
+func SelectGuardsByCondition(ctx context.Context, db *sql.DB, id int64) ([]Guard, error) {
+	var q = `SELECT condition_operation_id, operation_id, branch, arg FROM operation_guards
+	WHERE condition_operation_id = $1 ORDER BY operation_id, arg`
+	return selectGuards(ctx, db, q, id)
+}
+
+func SelectGuardsByExprId(ctx context.Context, db *sql.DB, exprId int64) ([]Guard, error) {
+	var q = `SELECT g.condition_operation_id, g.operation_id, g.branch, g.arg FROM operation_guards g
+	JOIN operations o ON o.id = g.operation_id
+	WHERE o.expression_id = $1 ORDER BY g.condition_operation_id, g.operation_id, g.arg`
+	return selectGuards(ctx, db, q, exprId)
+}
+
+// SelectUnresolvedGuards возвращает условия, которые уже посчитаны, но
+// зависящие от них операции об этом так и не узнали.
+func SelectUnresolvedGuards(ctx context.Context, db *sql.DB) ([]Guard, error) {
+	var q = `SELECT g.condition_operation_id, g.operation_id, g.branch, g.arg FROM operation_guards g
+	JOIN operations o ON o.id = g.condition_operation_id
+	WHERE o.state = 'calculated' AND g.resolved = 0`
+	return selectGuards(ctx, db, q)
+}
+
+// ResolveGuard сообщает операции, какая ветка выбрана. Возвращает true, если
+// после этого операция готова к вычислению. Как и SetOperationArg, повторный
+// вызов ничего не меняет.
+func ResolveGuard(ctx context.Context, db *sql.DB, g Guard, branch bool) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var q = `UPDATE operation_guards SET resolved = 1
+	WHERE condition_operation_id = $1 AND operation_id = $2 AND arg = $3 AND resolved = 0`
+	result, err := tx.ExecContext(ctx, q, g.Condition, g.Oper, g.Arg)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if g.Arg == -1 && branch != g.Branch {
+		q = "UPDATE operations SET state = 'skipped' WHERE id = $1"
+		_, err = tx.ExecContext(ctx, q, g.Oper)
+		if err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+	if g.Arg >= 0 {
+		if branch == g.Branch {
+			return false, tx.Commit()
+		}
+		q = "UPDATE operands SET value = 0, exact = '0', ready = 1 WHERE operation_id = $1 AND position = $2 AND ready = 0"
+		result, err = tx.ExecContext(ctx, q, g.Oper, g.Arg)
+		if err != nil {
+			return false, err
+		}
+		n, err = result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			// аргумент уже пришёл
+			return false, tx.Commit()
+		}
+	}
+
+	var waiting int64
+	var state string
+	q = "UPDATE operations SET waiting = waiting - 1 WHERE id = $1 RETURNING waiting, state"
+	err = tx.QueryRowContext(ctx, q, g.Oper).Scan(&waiting, &state)
+	if err != nil {
+		return false, err
+	}
+	// пропущенная операция остаётся пропущенной, даже если дождалась всего
+	ready := waiting == 0 && state != "skipped"
+	if ready {
+		q = "UPDATE operations SET state = 'ready_to_calc' WHERE id = $1"
+		_, err = tx.ExecContext(ctx, q, g.Oper)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return ready, tx.Commit()
+}
@@ -3,45 +3,85 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type (
+	Operand struct {
+		Value float64
+		// точное значение, пустое - если его нет
+		Exact string
+		// не nil - аргумент является списком
+		List  []float64
+		Ready bool
+	}
 	Operation struct {
-		Id                  int64
-		ExprId              int64
-		A                   float64
-		B                   float64
-		Oper                string
-		Res                 sql.NullFloat64
-		State               string
-		NotifyOperationId   int64
-		NotifyOperationSide string
-		Final               int64
+		Id      int64
+		ExprId  int64
+		Args    []Operand
+		Oper    string
+		Res     sql.NullFloat64
+		State   string
+		Waiting int64
+		Final   int64
+		// считать операцию точно, если у всех аргументов есть точные значения
+		Exact    bool
+		ExactRes sql.NullString
+		// адрес вычислителя, который посчитал операцию, и сколько это заняло
+		Worker     sql.NullString
+		DurationMs sql.NullFloat64
+		// время окончания вычисления, unix-время в миллисекундах
+		CalculatedAt sql.NullInt64
+		// длина списка-результата, 0 - результат число
+		Length  int64
+		ResList []float64
+		// End > 0 - операция считает только элементы [Start, End) своих
+		// аргументов-списков, см. SliceArgs
+		Start int64
+		End   int64
+		// свёртка по диапазону: тело, индекс и имена остальных значений,
+		// см. calc.RangeOperations
+		Body   string
+		Params []string
 	}
 )
 
-func CreateOpersTable(ctx context.Context, db *sql.DB) error {
-	const (
-		opersTable = `
+const operationColumns = "id, oper, res, state, waiting, expression_id, final, exact, exact_res, worker, duration_ms, calculated_at, " +
+	"length, res_list, slice_start, slice_end, body, params"
+
+const (
+	opersTable = `
 		CREATE TABLE "operations" (
 			"id"	INTEGER,
-			"a"	REAL,
-			"b"	REAL,
 			"oper"	TEXT NOT NULL,
 			"res"	REAL,
 			"state"	TEXT NOT NULL,
+			"waiting"	INTEGER NOT NULL DEFAULT 0,
 			"expression_id"	INTEGER NOT NULL,
 			"final"	INTEGER,
-			"notify_operation_id"	INTEGER,
-			"notify_operation_side"	TEXT,
+			"exact"	INTEGER NOT NULL DEFAULT 0,
+			"exact_res"	TEXT,
+			"worker"	TEXT,
+			"duration_ms"	REAL,
+			"calculated_at"	INTEGER,
+			"length"	INTEGER NOT NULL DEFAULT 0,
+			"res_list"	TEXT,
+			"slice_start"	INTEGER NOT NULL DEFAULT 0,
+			"slice_end"	INTEGER NOT NULL DEFAULT 0,
+			"body"	TEXT,
+			"params"	TEXT,
 			FOREIGN KEY("expression_id") REFERENCES "expressions"("id"),
 			PRIMARY KEY("id" AUTOINCREMENT)
 		);`
-	)
+)
 
+func CreateOpersTable(ctx context.Context, db *sql.DB) error {
 	if _, err := db.ExecContext(ctx, opersTable); err != nil {
 		return err
 	}
@@ -49,96 +89,203 @@ func CreateOpersTable(ctx context.Context, db *sql.DB) error {
 	return nil
 }
 
+const (
+	operandsTable = `
+		CREATE TABLE "operands" (
+			"operation_id"	INTEGER NOT NULL,
+			"position"	INTEGER NOT NULL,
+			"value"	REAL,
+			"exact"	TEXT,
+			"list"	TEXT,
+			"ready"	INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY("operation_id") REFERENCES "operations"("id"),
+			PRIMARY KEY("operation_id", "position")
+		);`
+)
+
+func CreateOperandsTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, operandsTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (o Operation) Print() string {
 	id := strconv.FormatInt(o.Id, 10)
 	exprId := strconv.FormatInt(o.ExprId, 10)
-	a := strconv.FormatFloat(o.A, 'f', -1, 64)
-	b := strconv.FormatFloat(o.B, 'f', -1, 64)
+	args := ""
+	for i, arg := range o.Args {
+		if i > 0 {
+			args += ", "
+		}
+		args += strconv.FormatFloat(arg.Value, 'f', -1, 64)
+	}
 	res := strconv.FormatFloat(o.Res.Float64, 'f', -1, 64)
-	return "Id: " + id + " ExprId: " + exprId + " A: " + a + " B: " + b + " Oper: " + o.Oper + " State: " + o.State + " Res: " + res
+	return "Id: " + id + " ExprId: " + exprId + " Args: [" + args + "] Oper: " + o.Oper + " State: " + o.State + " Res: " + res
 }
 
-func InsertOperation(ctx context.Context, db *sql.DB, o *Operation) (int64, error) {
+// InsertOperation записывает операцию вместе с аргументами. В колонку oper
+// попадают только операции, которые умеют вычислители, см. calc.Operations.
+func InsertOperation(ctx context.Context, db Querier, o *Operation) (int64, error) {
+	if !calc.IsKnown(o.Oper) {
+		return 0, fmt.Errorf("unknown operation %q", o.Oper)
+	}
 	var q = `
-	INSERT INTO operations (expression_id, a, b, oper, state,
-		 notify_operation_id, notify_operation_side, final) 
-		 values ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO operations (expression_id, oper, state, waiting, final, exact, length, slice_start, slice_end, body, params)
+		 values ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''))
 	`
-	result, err := db.ExecContext(ctx, q, o.ExprId, o.A, o.B, o.Oper, o.State,
-		o.NotifyOperationId, o.NotifyOperationSide, o.Final)
+	var id int64
+	err := inTx(ctx, db, func(tx Querier) error {
+		result, err := tx.ExecContext(ctx, q, o.ExprId, o.Oper, o.State, o.Waiting, o.Final, o.Exact, o.Length, o.Start, o.End,
+			o.Body, strings.Join(o.Params, ","))
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		q = "INSERT INTO operands (operation_id, position, value, exact, list, ready) values ($1, $2, $3, NULLIF($4, ''), $5, $6)"
+		for i, arg := range o.Args {
+			_, err = tx.ExecContext(ctx, q, id, i, arg.Value, arg.Exact, FormatList(arg.List), arg.Ready)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
-	id, err := result.LastInsertId()
+	return id, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// Querier - база или открытая в ней транзакция
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// inTx выполняет f в транзакции. Если db - уже транзакция, f выполняется
+// в ней, и фиксирует её тот, кто её открыл.
+func inTx(ctx context.Context, db Querier, f func(tx Querier) error) error {
+	d, ok := db.(*sql.DB)
+	if !ok {
+		return f(db)
+	}
+	tx, err := d.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return id, nil
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func SelectOperations(ctx context.Context, db *sql.DB) ([]Operation, error) {
-	var operations []Operation
-	var q = "SELECT * FROM operations"
-	rows, err := db.QueryContext(ctx, q)
+func scanOperation(row scanner) (Operation, error) {
+	o := Operation{}
+	var final sql.NullInt64
+	var resList, body, params sql.NullString
+	err := row.Scan(&o.Id, &o.Oper, &o.Res, &o.State, &o.Waiting, &o.ExprId, &final, &o.Exact, &o.ExactRes,
+		&o.Worker, &o.DurationMs, &o.CalculatedAt, &o.Length, &resList, &o.Start, &o.End, &body, &params)
+	o.Final = final.Int64
+	if err != nil {
+		return o, err
+	}
+	o.Body = body.String
+	if params.String != "" {
+		o.Params = strings.Split(params.String, ",")
+	}
+	o.ResList, err = ParseList(resList)
+	return o, err
+}
+
+func selectOperands(ctx context.Context, db Querier, id int64) ([]Operand, error) {
+	var operands []Operand
+	var q = "SELECT value, exact, list, ready FROM operands WHERE operation_id = $1 ORDER BY position"
+	rows, err := db.QueryContext(ctx, q, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		o := Operation{}
-		err := rows.Scan(&o.Id, &o.ExprId, &o.A, &o.B, &o.Oper, &o.Res, &o.State,
-			&o.NotifyOperationId, &o.NotifyOperationSide, &o.Final)
+		var value sql.NullFloat64
+		var exact, list sql.NullString
+		a := Operand{}
+		err := rows.Scan(&value, &exact, &list, &a.Ready)
 		if err != nil {
 			return nil, err
 		}
-		operations = append(operations, o)
-	}
-	return operations, nil
-}
-
-func SelectOperationById(ctx context.Context, db *sql.DB, id int64) (Operation, error) {
-	o := Operation{}
-	var q = `SELECT * FROM operations WHERE id = $1`
-	err := db.QueryRowContext(ctx, q, id).Scan(&o.Id, &o.A, &o.B, &o.Oper, &o.Res, &o.State, &o.ExprId, &o.Final,
-		&o.NotifyOperationId, &o.NotifyOperationSide)
-	if err != nil {
-		panic(err)
+		a.Value = value.Float64
+		a.Exact = exact.String
+		a.List, err = ParseList(list)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, a)
 	}
-
-	return o, nil
+	return operands, rows.Err()
 }
 
-func SelectOperationsToCalc(ctx context.Context, db *sql.DB) ([]Operation, error) {
+func selectOperations(ctx context.Context, db *sql.DB, q string, args ...any) ([]Operation, error) {
 	var operations []Operation
-	var q = `SELECT * FROM operations WHERE state IN ('created', 'ready_to_calc')`
-	rows, err := db.QueryContext(ctx, q)
+	rows, err := db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 	for rows.Next() {
-		o := Operation{}
-		err := rows.Scan(&o.Id, &o.A, &o.B, &o.Oper, &o.Res, &o.State, &o.ExprId, &o.Final,
-			&o.NotifyOperationId, &o.NotifyOperationSide)
+		o, err := scanOperation(rows)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
 		operations = append(operations, o)
 	}
+	rows.Close()
+
+	for i := range operations {
+		operations[i].Args, err = selectOperands(ctx, db, operations[i].Id)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return operations, nil
 }
 
-func SetOperationNotification(ctx context.Context, db *sql.DB, id int64, receiver_id int64, num_side string) error {
-	var q = "UPDATE operations SET notify_operation_id = $1, notify_operation_side = $2 WHERE id = $3"
-	_, err := db.ExecContext(ctx, q, receiver_id, num_side, id)
+func SelectOperations(ctx context.Context, db *sql.DB) ([]Operation, error) {
+	return selectOperations(ctx, db, "SELECT "+operationColumns+" FROM operations")
+}
+
+func SelectOperationsByExprId(ctx context.Context, db *sql.DB, exprId int64) ([]Operation, error) {
+	var q = "SELECT " + operationColumns + " FROM operations WHERE expression_id = $1 ORDER BY id"
+	return selectOperations(ctx, db, q, exprId)
+}
+
+func SelectOperationById(ctx context.Context, db Querier, id int64) (Operation, error) {
+	var q = "SELECT " + operationColumns + " FROM operations WHERE id = $1"
+	o, err := scanOperation(db.QueryRowContext(ctx, q, id))
 	if err != nil {
-		panic(err)
+		return o, err
 	}
+	o.Args, err = selectOperands(ctx, db, id)
+	return o, err
+}
 
-	return nil
+func SelectOperationsToCalc(ctx context.Context, db *sql.DB) ([]Operation, error) {
+	var q = "SELECT " + operationColumns + " FROM operations WHERE state IN ('created', 'ready_to_calc')"
+	return selectOperations(ctx, db, q)
 }
 
-func MakeOperationFinal(ctx context.Context, db *sql.DB, id int64) error {
+func MakeOperationFinal(ctx context.Context, db Querier, id int64) error {
 	var q = "UPDATE operations SET final = 1 WHERE id = $1"
 	_, err := db.ExecContext(ctx, q, id)
 	if err != nil {
@@ -148,14 +295,48 @@ func MakeOperationFinal(ctx context.Context, db *sql.DB, id int64) error {
 	return nil
 }
 
-func SetOperationNum(ctx context.Context, db *sql.DB, id int64, side string, number float64) error {
-	var q string
-	if side == "left" {
-		q = "UPDATE operations SET A = $1 WHERE id = $2"
-	} else {
-		q = "UPDATE operations SET B = $1 WHERE id = $2"
-	}
-	_, err := db.ExecContext(ctx, q, number, id)
+// SetOperationArg записывает аргумент операции (exact - его точное значение
+// или пустая строка, list - значение-список или nil) и возвращает true,
+// если это был последний аргумент, которого она ждала; тогда операция
+// в той же транзакции переходит в ready_to_calc.
+// Повторная запись того же аргумента ничего не меняет, поэтому результат
+// можно безопасно доставлять ещё раз после перезапуска.
+func SetOperationArg(ctx context.Context, db Querier, id int64, position int64, number float64, exact string, list []float64) (bool, error) {
+	var ready bool
+	err := inTx(ctx, db, func(tx Querier) error {
+		var q = `UPDATE operands SET value = $1, exact = NULLIF($2, ''), list = $3, ready = 1
+		WHERE operation_id = $4 AND position = $5 AND ready = 0`
+		result, err := tx.ExecContext(ctx, q, number, exact, FormatList(list), id, position)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		var waiting int64
+		q = "UPDATE operations SET waiting = waiting - 1 WHERE id = $1 RETURNING waiting"
+		err = tx.QueryRowContext(ctx, q, id).Scan(&waiting)
+		if err != nil {
+			return err
+		}
+		if waiting == 0 {
+			q = "UPDATE operations SET state = 'ready_to_calc' WHERE id = $1"
+			_, err = tx.ExecContext(ctx, q, id)
+			if err != nil {
+				return err
+			}
+		}
+		ready = waiting == 0
+		return nil
+	})
+	return ready, err
+}
+
+func SetOperationRes(ctx context.Context, db *sql.DB, id int64, res float64, exact string, list []float64) error {
+	var q = "UPDATE operations SET res = $1, exact_res = NULLIF($2, ''), res_list = $3 WHERE id = $4"
+	number := sql.NullFloat64{Float64: res, Valid: list == nil}
+	_, err := db.ExecContext(ctx, q, number, exact, FormatList(list), id)
 	if err != nil {
 		return err
 	}
@@ -163,9 +344,10 @@ func SetOperationNum(ctx context.Context, db *sql.DB, id int64, side string, num
 	return nil
 }
 
-func SetOperationRes(ctx context.Context, db *sql.DB, id int64, res float64) error {
-	var q = "UPDATE operations SET res = $1 WHERE id = $2"
-	_, err := db.ExecContext(ctx, q, res, id)
+// SetOperationTrace запоминает, кто и сколько считал операцию, см. SelectOperationsTrace.
+func SetOperationTrace(ctx context.Context, db *sql.DB, id int64, worker string, duration time.Duration) error {
+	var q = "UPDATE operations SET worker = $1, duration_ms = $2, calculated_at = $3 WHERE id = $4"
+	_, err := db.ExecContext(ctx, q, worker, float64(duration.Microseconds())/1000, time.Now().UnixMilli(), id)
 	if err != nil {
 		return err
 	}
@@ -182,3 +364,66 @@ func SetOperationState(ctx context.Context, db *sql.DB, id int64, state string)
 
 	return nil
 }
+
+// SelectOperationsTrace возвращает посчитанные операции выражения в том порядке,
+// в котором вычислители их закончили.
+func SelectOperationsTrace(ctx context.Context, db *sql.DB, exprId int64) ([]Operation, error) {
+	var q = "SELECT " + operationColumns + ` FROM operations
+	WHERE expression_id = $1 AND state = 'calculated' ORDER BY calculated_at, id`
+	return selectOperations(ctx, db, q, exprId)
+}
+
+// SelectFinalOperation возвращает операцию, результат которой станет результатом выражения.
+func SelectFinalOperation(ctx context.Context, db *sql.DB, exprId int64) (Operation, error) {
+	var q = "SELECT " + operationColumns + " FROM operations WHERE expression_id = $1 AND final = 1"
+	o, err := scanOperation(db.QueryRowContext(ctx, q, exprId))
+	if err != nil {
+		return o, err
+	}
+	o.Args, err = selectOperands(ctx, db, o.Id)
+	return o, err
+}
+
+// SliceArgs возвращает аргументы-списки операции, которая считает только
+// часть [Start, End): аргументы длиннее части обрезаются, остальные уже
+// подготовлены при планировании.
+func (o Operation) SliceArgs() [][]float64 {
+	lists := make([][]float64, len(o.Args))
+	for i, arg := range o.Args {
+		lists[i] = arg.List
+		if o.End > 0 && int64(len(arg.List)) > o.End-o.Start {
+			lists[i] = arg.List[o.Start:o.End]
+		}
+	}
+	return lists
+}
+
+// FormatList записывает список для хранения в базе: числа через запятую.
+// В отличие от JSON так можно записать и Inf, и NaN. nil - NULL.
+func FormatList(list []float64) sql.NullString {
+	if list == nil {
+		return sql.NullString{}
+	}
+	items := make([]string, len(list))
+	for i, x := range list {
+		items[i] = strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return sql.NullString{String: strings.Join(items, ","), Valid: true}
+}
+
+// ParseList читает список, записанный FormatList.
+func ParseList(s sql.NullString) ([]float64, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	items := strings.Split(s.String, ",")
+	list := make([]float64, len(items))
+	for i, item := range items {
+		x, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = x
+	}
+	return list, nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type table struct {
+	name   string
+	ddl    string
+	create func(ctx context.Context, db *sql.DB) error
+}
+
+// tables - все таблицы базы в порядке создания
+var tables = []table{
+	{"users", usersTable, CreateUsersTable},
+	{"expressions", expressionsTable, CreateExpressionsTable},
+	{"operations", opersTable, CreateOpersTable},
+	{"operands", operandsTable, CreateOperandsTable},
+	{"operation_edges", edgesTable, CreateEdgesTable},
+	{"folds", foldsTable, CreateFoldsTable},
+	{"expression_values", valuesTable, CreateValuesTable},
+	{"operation_guards", guardsTable, CreateGuardsTable},
+	{"functions", functionsTable, CreateFunctionsTable},
+}
+
+// Migrate приводит базу к текущей схеме: создаёт недостающие таблицы и
+// добавляет в существующие новые колонки. Если таблицу так не привести
+// (в ней осталась обязательная колонка, которой в схеме больше нет),
+// возвращает ошибку - такую базу надо пересоздать.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	for _, t := range tables {
+		existing, err := tableColumns(ctx, db, t.name)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			if err := t.create(ctx, db); err != nil {
+				return fmt.Errorf("create table %s: %w", t.name, err)
+			}
+			continue
+		}
+
+		columns := ddlColumns(t.ddl)
+		for _, c := range columns {
+			if _, ok := existing[c.name]; ok {
+				continue
+			}
+			q := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN %s`, t.name, c.definition)
+			if _, err := db.ExecContext(ctx, q); err != nil {
+				return fmt.Errorf("table %s: add column %s: %w", t.name, c.name, err)
+			}
+		}
+		for name, required := range existing {
+			if required && !hasColumn(columns, name) {
+				return fmt.Errorf("table %s: column %s is required but no longer used, recreate the database", t.name, name)
+			}
+		}
+	}
+	_, err := db.ExecContext(ctx, canonicalIndex)
+	return err
+}
+
+type column struct {
+	name       string
+	definition string
+}
+
+// ddlColumns разбирает колонки из CREATE TABLE: по одной на строку, `"имя"	ТИП ...,`
+func ddlColumns(ddl string) []column {
+	var columns []column
+	for _, line := range strings.Split(ddl, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+		name, _, ok := strings.Cut(line[1:], `"`)
+		if !ok {
+			continue
+		}
+		columns = append(columns, column{name: name, definition: strings.TrimSuffix(line, ",")})
+	}
+	return columns
+}
+
+func hasColumn(columns []column, name string) bool {
+	for _, c := range columns {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tableColumns возвращает колонки таблицы; true - колонку обязательно
+// заполнять при вставке (NOT NULL без значения по умолчанию)
+func tableColumns(ctx context.Context, db *sql.DB, name string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info("%s")`, name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			column, kind     string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &column, &kind, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[column] = notNull == 1 && !defaultValue.Valid && pk == 0
+	}
+	return columns, rows.Err()
+}
@@ -20,17 +20,17 @@ type (
 	}
 )
 
-func CreateUsersTable(ctx context.Context, db *sql.DB) error {
-	const (
-		usersTable = `
+const (
+	usersTable = `
 			CREATE TABLE "users" (
 			"id"	INTEGER NOT NULL,
 			"login"	TEXT NOT NULL UNIQUE,
 			"pass_hash"	TEXT NOT NULL,
 			PRIMARY KEY("id" AUTOINCREMENT)
 		);`
-	)
+)
 
+func CreateUsersTable(ctx context.Context, db *sql.DB) error {
 	if _, err := db.ExecContext(ctx, usersTable); err != nil {
 		return err
 	}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// Value - имя, которому в скрипте присвоено значение.
+	// Значение либо известно сразу, либо это результат операции OperId.
+	Value struct {
+		Name   string          `json:"name"`
+		OperId sql.NullInt64   `json:"-"`
+		Res    sql.NullFloat64 `json:"res"`
+		// точное значение в выражении, которое считается точно
+		ExactRes sql.NullString `json:"exact_res"`
+		// значение-список, тогда Res не заполнен
+		List []float64 `json:"list,omitempty"`
+	}
+)
+
+const (
+	valuesTable = `
+		CREATE TABLE "expression_values" (
+			"expression_id"	INTEGER NOT NULL,
+			"position"	INTEGER NOT NULL,
+			"name"	TEXT NOT NULL,
+			"operation_id"	INTEGER,
+			"value"	REAL,
+			"exact"	TEXT,
+			"list"	TEXT,
+			FOREIGN KEY("expression_id") REFERENCES "expressions"("id"),
+			FOREIGN KEY("operation_id") REFERENCES "operations"("id"),
+			PRIMARY KEY("expression_id", "position")
+		);`
+)
+
+func CreateValuesTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, valuesTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func InsertValue(ctx context.Context, db Querier, exprId int64, position int, v Value) error {
+	var q = `
+	INSERT INTO expression_values (expression_id, position, name, operation_id, value, exact, list)
+		 values ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := db.ExecContext(ctx, q, exprId, position, v.Name, v.OperId, v.Res, v.ExactRes, FormatList(v.List))
+	return err
+}
+
+// SelectValuesByExprId возвращает присвоенные имена; пока операция
+// не посчитана, значение её имени не заполнено.
+func SelectValuesByExprId(ctx context.Context, db *sql.DB, exprId int64) ([]Value, error) {
+	var values []Value
+	var q = `
+	SELECT v.name, v.operation_id, COALESCE(v.value, o.res), COALESCE(v.exact, o.exact_res), COALESCE(v.list, o.res_list)
+		FROM expression_values v LEFT JOIN operations o ON o.id = v.operation_id
+		WHERE v.expression_id = $1 ORDER BY v.position
+	`
+	rows, err := db.QueryContext(ctx, q, exprId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v := Value{}
+		var list sql.NullString
+		err := rows.Scan(&v.Name, &v.OperId, &v.Res, &v.ExactRes, &list)
+		if err != nil {
+			return nil, err
+		}
+		v.List, err = ParseList(list)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Node - узел дерева разбора выражения.
+type Node interface {
+	String() string
+}
+
+type (
+	Literal struct {
+		Value float64
+		// точное значение числа из текста выражения, см. ParseNumber
+		Text string
+	}
+	// значение переменной подставляется при построении графа операций
+	Variable struct {
+		Name string
+		// где переменная стоит в тексте, для сообщения об ошибке
+		Column int
+	}
+	// Reference - результат ранее отправленного выражения, $42
+	Reference struct {
+		ExprId int64
+		// где ссылка стоит в тексте, для сообщения об ошибке
+		Column int
+	}
+	// Op - "-", "+" или "!"
+	Unary struct {
+		Op string
+		X  Node
+	}
+	Binary struct {
+		Op    string
+		Left  Node
+		Right Node
+	}
+	Call struct {
+		Name string
+		Args []Node
+		// где стоит имя функции, для сообщения об ошибке
+		Column int
+	}
+	// Conditional - c ? a : b или if(c, a, b); вычисляется только нужная ветка
+	Conditional struct {
+		Cond Node
+		Then Node
+		Else Node
+	}
+	// List - список [1, 2, x]; элементы - числа, вложенных списков нет
+	List struct {
+		Elems []Node
+	}
+)
+
+// приоритет, с которым узел печатается: чем меньше, тем чаще нужны скобки
+const (
+	ternaryPrecedence = 0
+	unaryPrecedence   = 7
+	atomPrecedence    = 10
+)
+
+func nodePrecedence(n Node) int {
+	switch n := n.(type) {
+	case *Literal:
+		if n.Value < 0 {
+			return unaryPrecedence
+		}
+	case *Unary:
+		return unaryPrecedence
+	case *Binary:
+		return operators[n.Op].precedence
+	case *Conditional:
+		return ternaryPrecedence
+	}
+	return atomPrecedence
+}
+
+// операнд печатается в скобках, если связывается слабее, чем нужно родителю
+func formatOperand(n Node, precedence int) string {
+	if nodePrecedence(n) < precedence {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+func (n *Literal) String() string {
+	return n.exact()
+}
+
+// exact - точное значение литерала для точного режима
+func (n *Literal) exact() string {
+	if n.Text != "" {
+		return n.Text
+	}
+	return strconv.FormatFloat(n.Value, 'f', -1, 64)
+}
+
+func (n *Variable) String() string {
+	return n.Name
+}
+
+func (n *Reference) String() string {
+	return "$" + strconv.FormatInt(n.ExprId, 10)
+}
+
+func (n *Unary) String() string {
+	return n.Op + formatOperand(n.X, unaryPrecedence)
+}
+
+func (n *Binary) String() string {
+	op := operators[n.Op]
+	left, right := op.precedence, op.precedence+1
+	if op.rightAssoc {
+		left, right = right, left
+	}
+	rightStr := formatOperand(n.Right, right)
+	if nodePrecedence(n.Right) == unaryPrecedence {
+		// справа от оператора префиксный минус не нужно брать в скобки
+		rightStr = n.Right.String()
+	}
+	return formatOperand(n.Left, left) + " " + n.Op + " " + rightStr
+}
+
+func (n *Conditional) String() string {
+	return formatOperand(n.Cond, ternaryPrecedence+1) + " ? " + n.Then.String() + " : " + n.Else.String()
+}
+
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+	return n.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (n *List) String() string {
+	elems := make([]string, len(n.Elems))
+	for i, elem := range n.Elems {
+		elems[i] = elem.String()
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
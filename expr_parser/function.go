@@ -0,0 +1,412 @@
+package parser
+
+import (
+	"context"
+	sql "database/sql"
+	"fmt"
+	"strings"
+
+	db "github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+)
+
+// наибольшее число узлов в выражении после подстановки функций пользователя:
+// f(x) = g(x) + g(x), g(x) = h(x) + h(x), ... растут экспоненциально
+const maxExpandedNodes = 10000
+
+// UserFunction - функция, которую пользователь определил сам: vat(x) = x * 1.2.
+// В теле могут быть только параметры, числа и вызовы функций.
+type UserFunction struct {
+	Name   string
+	Params []string
+	Body   Node
+}
+
+// ParseFunction разбирает определение функции "имя(параметры) = выражение".
+func ParseFunction(definition string) (UserFunction, error) {
+	var f UserFunction
+	tokens, err := SplitHumanExpressionToTokens(definition)
+	if err != nil {
+		return f, err
+	}
+	// expect возвращает i-й токен, если он нужного вида
+	expect := func(i int, kind TokenKind, msg string) (Token, error) {
+		if i >= len(tokens) {
+			column := 1
+			if len(tokens) > 0 {
+				last := tokens[len(tokens)-1]
+				column = last.Column + len([]rune(last.Text))
+			}
+			return Token{}, &SyntaxError{Msg: "unexpected end of function definition", Column: column}
+		}
+		if tokens[i].Kind != kind {
+			return Token{}, newSyntaxError(msg, tokens[i])
+		}
+		return tokens[i], nil
+	}
+
+	name, err := expect(0, TokenIdent, "expected function name")
+	if err != nil {
+		return f, err
+	}
+	if _, ok := functions[name.Text]; ok {
+		return f, newSyntaxError("cannot redefine function", name)
+	}
+	f.Name = name.Text
+	if _, err = expect(1, TokenLParen, "expected '(' after function name"); err != nil {
+		return f, err
+	}
+	f.Params = []string{}
+	i := 2
+	if i < len(tokens) && tokens[i].Kind == TokenRParen {
+		i++
+	} else {
+		for {
+			param, err := expect(i, TokenIdent, "expected parameter name")
+			if err != nil {
+				return f, err
+			}
+			if _, ok := functions[param.Text]; ok {
+				return f, newSyntaxError("parameter cannot be named as function", param)
+			}
+			for _, p := range f.Params {
+				if p == param.Text {
+					return f, newSyntaxError("duplicate parameter", param)
+				}
+			}
+			f.Params = append(f.Params, param.Text)
+			i++
+			if i < len(tokens) && tokens[i].Kind == TokenComma {
+				i++
+				continue
+			}
+			if _, err = expect(i, TokenRParen, "expected ',' or ')'"); err != nil {
+				return f, err
+			}
+			i++
+			break
+		}
+	}
+	if _, err = expect(i, TokenAssign, "expected '='"); err != nil {
+		return f, err
+	}
+	if i+1 == len(tokens) {
+		return f, &SyntaxError{Msg: "unexpected end of function definition", Column: tokens[i].Column + 1}
+	}
+
+	rpn, err := TokensToRPN(tokens[i+1:])
+	if err != nil {
+		return f, err
+	}
+	f.Body = RPNToAST(rpn)
+	return f, checkBody(f.Body, f.Params)
+}
+
+// checkBody проверяет, что тело функции зависит только от её параметров
+func checkBody(node Node, params []string) error {
+	switch n := node.(type) {
+	case *Variable:
+		for _, p := range params {
+			if p == n.Name {
+				return nil
+			}
+		}
+		return &SyntaxError{Msg: "unknown parameter", Token: n.Name, Column: n.Column}
+	case *Reference:
+		return &SyntaxError{Msg: "unexpected reference in function", Token: n.String(), Column: n.Column}
+	case *Unary:
+		return checkBody(n.X, params)
+	case *Binary:
+		if err := checkBody(n.Left, params); err != nil {
+			return err
+		}
+		return checkBody(n.Right, params)
+	case *Call:
+		index, ranged := rangeIndex(n)
+		for i, arg := range n.Args {
+			if ranged && i == 0 {
+				continue
+			}
+			if ranged && i == 3 {
+				// индекс свёртки в её теле - тоже параметр
+				params = append(params[:len(params):len(params)], index.Name)
+			}
+			if err := checkBody(arg, params); err != nil {
+				return err
+			}
+		}
+	case *Conditional:
+		for _, x := range []Node{n.Cond, n.Then, n.Else} {
+			if err := checkBody(x, params); err != nil {
+				return err
+			}
+		}
+	case *List:
+		for _, elem := range n.Elems {
+			if err := checkBody(elem, params); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadFunctions загружает функции пользователя.
+func LoadFunctions(ctx context.Context, d *sql.DB, userId int64) (map[string]UserFunction, error) {
+	stored, err := db.SelectFunctionsByUser(ctx, d, userId)
+	if err != nil {
+		return nil, err
+	}
+	funcs := map[string]UserFunction{}
+	for _, f := range stored {
+		body, err := Parse(f.Body)
+		if err != nil {
+			return nil, err
+		}
+		funcs[f.Name] = UserFunction{Name: f.Name, Params: f.Params, Body: body}
+	}
+	return funcs, nil
+}
+
+// CheckFunction проверяет, что новую функцию f можно раскрыть вместе с уже
+// определёнными funcs: нет рекурсии и выражение не слишком большое.
+func CheckFunction(f UserFunction, funcs map[string]UserFunction) error {
+	all := map[string]UserFunction{f.Name: f}
+	for name, g := range funcs {
+		if name != f.Name {
+			all[name] = g
+		}
+	}
+	call := &Call{Name: f.Name, Column: 1}
+	for _, p := range f.Params {
+		call.Args = append(call.Args, &Variable{Name: p})
+	}
+	_, err := ExpandFunctions([]Statement{{Expr: call}}, all)
+	return err
+}
+
+// ExpandFunctions подставляет тела функций пользователя вместо их вызовов,
+// так что дальше выражение состоит только из встроенных операций.
+// Ошибки внутри тел функций относятся к вызову в тексте выражения.
+func ExpandFunctions(script []Statement, funcs map[string]UserFunction) ([]Statement, error) {
+	expanded := make([]Statement, len(script))
+	for i, statement := range script {
+		e := expander{funcs: funcs}
+		node, _, err := e.expand(statement.Expr)
+		if err != nil {
+			return nil, err
+		}
+		expanded[i] = Statement{Name: statement.Name, Expr: node}
+	}
+	return expanded, nil
+}
+
+type (
+	// sizedNode - подставляемый аргумент и число узлов в нём
+	sizedNode struct {
+		node Node
+		size int
+	}
+	expander struct {
+		funcs map[string]UserFunction
+		// функции, тела которых сейчас подставляются
+		stack []string
+		// вызов в тексте выражения, внутри которого идёт подстановка
+		call *Call
+		// значения параметров функции, тело которой подставляется
+		params map[string]sizedNode
+	}
+)
+
+func (e *expander) error(msg string, token string, column int) error {
+	if len(e.stack) > 0 {
+		msg += " in function " + e.stack[len(e.stack)-1]
+		column = e.call.Column
+	}
+	return &SyntaxError{Msg: msg, Token: token, Column: column}
+}
+
+// expand возвращает узел с подставленными функциями и число узлов в нём
+func (e *expander) expand(node Node) (Node, int, error) {
+	switch n := node.(type) {
+	case *Variable:
+		if arg, ok := e.params[n.Name]; ok {
+			return arg.node, arg.size, nil
+		}
+		return n, 1, nil
+	case *Unary:
+		x, size, err := e.expand(n.X)
+		if err != nil {
+			return nil, 0, err
+		}
+		return e.limit(&Unary{Op: n.Op, X: x}, size+1)
+	case *Binary:
+		left, leftSize, err := e.expand(n.Left)
+		if err != nil {
+			return nil, 0, err
+		}
+		right, rightSize, err := e.expand(n.Right)
+		if err != nil {
+			return nil, 0, err
+		}
+		return e.limit(&Binary{Op: n.Op, Left: left, Right: right}, leftSize+rightSize+1)
+	case *Conditional:
+		parts := make([]Node, 3)
+		size := 1
+		for i, x := range []Node{n.Cond, n.Then, n.Else} {
+			part, partSize, err := e.expand(x)
+			if err != nil {
+				return nil, 0, err
+			}
+			parts[i] = part
+			size += partSize
+		}
+		return e.limit(&Conditional{Cond: parts[0], Then: parts[1], Else: parts[2]}, size)
+	case *List:
+		list := &List{}
+		size := 1
+		for _, elem := range n.Elems {
+			x, elemSize, err := e.expand(elem)
+			if err != nil {
+				return nil, 0, err
+			}
+			list.Elems = append(list.Elems, x)
+			size += elemSize
+		}
+		return e.limit(list, size)
+	case *Call:
+		args := make([]sizedNode, len(n.Args))
+		size := 1
+		index, ranged := rangeIndex(n)
+		var indexName string
+		if ranged {
+			indexName = index.Name
+			index = e.freshIndex(n, index)
+		}
+		for i, arg := range n.Args {
+			if ranged && i == 0 {
+				args[i] = sizedNode{index, 1}
+				size++
+				continue
+			}
+			outer := e.params
+			if ranged && i == 3 {
+				// индекс свёртки закрывает одноимённый параметр функции
+				e.params = map[string]sizedNode{}
+				for name, value := range outer {
+					if name != indexName {
+						e.params[name] = value
+					}
+				}
+				if index.Name != indexName {
+					e.params[indexName] = sizedNode{index, 1}
+				}
+			}
+			x, argSize, err := e.expand(arg)
+			e.params = outer
+			if err != nil {
+				return nil, 0, err
+			}
+			args[i] = sizedNode{x, argSize}
+			size += argSize
+		}
+		if _, ok := functions[n.Name]; ok {
+			call := &Call{Name: n.Name, Column: n.Column}
+			for _, arg := range args {
+				call.Args = append(call.Args, arg.node)
+			}
+			return e.limit(call, size)
+		}
+		return e.substitute(n, args)
+	}
+	return node, 1, nil
+}
+
+// freshIndex возвращает индекс свёртки n из тела функции. Если в подставляемых
+// аргументах есть переменная с тем же именем, индекс переименовывается, иначе
+// он захватил бы её: f(x) = sum(i, 1, 3, x) при i = 5 и f(i) даёт 15, а не 6.
+func (e *expander) freshIndex(n *Call, index *Variable) *Variable {
+	taken := map[string]bool{}
+	for name, arg := range e.params {
+		if name == index.Name {
+			continue
+		}
+		for _, v := range freeValues(arg.node, nil, nil) {
+			taken[v.String()] = true
+		}
+	}
+	if !taken[index.Name] {
+		return index
+	}
+	// новое имя не должно совпасть и с именами внутри самой свёртки
+	variableNames(n, taken)
+	for k := 1; ; k++ {
+		name := fmt.Sprintf("%s_%d", index.Name, k)
+		if !taken[name] {
+			return &Variable{Name: name, Column: index.Column}
+		}
+	}
+}
+
+// variableNames добавляет в names имена всех переменных выражения, включая индексы
+func variableNames(node Node, names map[string]bool) {
+	switch n := node.(type) {
+	case *Variable:
+		names[n.Name] = true
+	case *Unary:
+		variableNames(n.X, names)
+	case *Binary:
+		variableNames(n.Left, names)
+		variableNames(n.Right, names)
+	case *Conditional:
+		variableNames(n.Cond, names)
+		variableNames(n.Then, names)
+		variableNames(n.Else, names)
+	case *List:
+		for _, elem := range n.Elems {
+			variableNames(elem, names)
+		}
+	case *Call:
+		for _, arg := range n.Args {
+			variableNames(arg, names)
+		}
+	}
+}
+
+// substitute подставляет тело функции пользователя с аргументами args
+func (e *expander) substitute(n *Call, args []sizedNode) (Node, int, error) {
+	f, ok := e.funcs[n.Name]
+	if !ok {
+		return nil, 0, e.error("unknown function", n.Name, n.Column)
+	}
+	if len(args) != len(f.Params) {
+		return nil, 0, e.error(wrongArgc(len(args)), n.Name, n.Column)
+	}
+	for i, name := range e.stack {
+		if name == f.Name {
+			chain := strings.Join(append(e.stack[i:], f.Name), " -> ")
+			return nil, 0, &SyntaxError{Msg: "recursive function", Token: chain, Column: e.call.Column}
+		}
+	}
+
+	params := map[string]sizedNode{}
+	for i, p := range f.Params {
+		params[p] = args[i]
+	}
+	outer := *e
+	if e.call == nil {
+		e.call = n
+	}
+	e.stack = append(e.stack, f.Name)
+	e.params = params
+	body, size, err := e.expand(f.Body)
+	e.stack, e.call, e.params = outer.stack, outer.call, outer.params
+	return body, size, err
+}
+
+// limit не даёт подстановке функций разрастись больше maxExpandedNodes
+func (e *expander) limit(node Node, size int) (Node, int, error) {
+	if e.call != nil && size > maxExpandedNodes {
+		return nil, 0, &SyntaxError{Msg: "function expansion too large", Token: e.call.Name, Column: e.call.Column}
+	}
+	return node, size, nil
+}
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"fmt"
+	"unicode"
+)
+
+type TokenKind int
+
+const (
+	TokenNumber TokenKind = iota
+	// ссылка на результат другого выражения: $42
+	TokenReference
+	TokenIdent
+	// имя переменной; лексер выдаёт его как TokenIdent,
+	// TokensToRPN отличает переменные от функций
+	TokenVariable
+	TokenOperator
+	TokenUnary
+	TokenLParen
+	TokenRParen
+	TokenComma
+	// "=" в присваивании и ";" между инструкциями скрипта
+	TokenAssign
+	TokenSemicolon
+	// части условного оператора c ? a : b
+	TokenQuestion
+	TokenColon
+	// скобки списка [1, 2, 3]
+	TokenLBracket
+	TokenRBracket
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string
+	// позиция первого символа токена, считая с 1
+	Column int
+	// для вызова функции и списка в RPN - число аргументов или элементов
+	Argc int
+}
+
+// SyntaxError описывает ошибку в тексте выражения.
+type SyntaxError struct {
+	Msg    string `json:"error"`
+	Token  string `json:"token"`
+	Column int    `json:"column"`
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at column %d", e.Msg, e.Column)
+	}
+	return fmt.Sprintf("%s %q at column %d", e.Msg, e.Token, e.Column)
+}
+
+func newSyntaxError(msg string, t Token) *SyntaxError {
+	return &SyntaxError{Msg: msg, Token: t.Text, Column: t.Column}
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || isDigit(r)
+}
+
+// операторы из двух символов
+var twoRuneOperators = map[string]bool{
+	"<=": true,
+	">=": true,
+	"==": true,
+	"!=": true,
+	"&&": true,
+	"||": true,
+	"//": true,
+}
+
+func SplitHumanExpressionToTokens(expression string) ([]Token, error) {
+	var tokens []Token
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		var kind TokenKind
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		// "_1" - не имя, а число с "_" не между цифрами
+		case isDigit(r) || (r == '.' || r == '_') && i+1 < len(runes) && isDigit(runes[i+1]):
+			i = scanNumber(runes, i)
+			if _, _, err := ParseNumber(string(runes[start:i])); err != nil {
+				return nil, &SyntaxError{
+					Msg:    err.Error(),
+					Token:  string(runes[start:i]),
+					Column: start + 1,
+				}
+			}
+			kind = TokenNumber
+		case r == '$':
+			i++
+			for i < len(runes) && isDigit(runes[i]) {
+				i++
+			}
+			if i == start+1 {
+				return nil, &SyntaxError{
+					Msg:    "invalid reference",
+					Token:  string(r),
+					Column: start + 1,
+				}
+			}
+			kind = TokenReference
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			kind = TokenIdent
+		case r == '+' || r == '-':
+			i++
+			kind = TokenOperator
+			// "+" и "-" без левого операнда - унарные
+			if len(tokens) == 0 {
+				kind = TokenUnary
+			} else {
+				switch tokens[len(tokens)-1].Kind {
+				case TokenOperator, TokenUnary, TokenLParen, TokenComma, TokenAssign, TokenSemicolon,
+					TokenQuestion, TokenColon, TokenLBracket:
+					kind = TokenUnary
+				}
+			}
+		case i+1 < len(runes) && twoRuneOperators[string(runes[i:i+2])]:
+			i += 2
+			kind = TokenOperator
+		case r == '*' || r == '/' || r == '%' || r == '^':
+			i++
+			kind = TokenOperator
+		case r == '<' || r == '>':
+			i++
+			kind = TokenOperator
+		case r == '!':
+			i++
+			kind = TokenUnary
+		case r == '?':
+			i++
+			kind = TokenQuestion
+		case r == ':':
+			i++
+			kind = TokenColon
+		case r == '(':
+			i++
+			kind = TokenLParen
+		case r == ')':
+			i++
+			kind = TokenRParen
+		case r == '[':
+			i++
+			kind = TokenLBracket
+		case r == ']':
+			i++
+			kind = TokenRBracket
+		case r == ',':
+			i++
+			kind = TokenComma
+		case r == '=':
+			i++
+			kind = TokenAssign
+		case r == ';':
+			i++
+			kind = TokenSemicolon
+		default:
+			return nil, &SyntaxError{
+				Msg:    "unexpected character",
+				Token:  string(r),
+				Column: start + 1,
+			}
+		}
+
+		tokens = append(tokens, Token{
+			Kind:   kind,
+			Text:   string(runes[start:i]),
+			Column: start + 1,
+		})
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,72 @@
+package parser
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+)
+
+var (
+	errInvalidNumber = errors.New("invalid number")
+	errNumberRange   = errors.New("number out of range")
+)
+
+// десятичное число: 12, 1.5, .5, 6.02E23, 1e-9; "_" можно ставить между цифрами
+var decimalNumber = regexp.MustCompile(`^(\d+(_\d+)*)?(\.\d+(_\d+)*)?([eE][+-]?\d+)?$`)
+
+// шестнадцатеричное целое: 0x1F, 0xFF_FF
+var hexNumber = regexp.MustCompile(`^0[xX][0-9a-fA-F]+(_[0-9a-fA-F]+)*$`)
+
+// scanNumber возвращает конец записи числа, начинающейся с runes[i].
+// Забирает всё, что может относиться к числу, в том числе буквы сразу после
+// цифр: "12abc" - одна неправильная запись, а не число и переменная.
+func scanNumber(runes []rune, i int) int {
+	hex := i+1 < len(runes) && runes[i] == '0' && (runes[i+1] == 'x' || runes[i+1] == 'X')
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case isIdentRune(r) || r == '.':
+			i++
+		case (r == '+' || r == '-') && !hex && (runes[i-1] == 'e' || runes[i-1] == 'E'):
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// ParseNumber разбирает запись числа из выражения и возвращает его значение
+// и точную запись для точного режима: десятичную дробь без "_" и экспоненты.
+// Число, которое не помещается в float64 или округляется до 0, - ошибка.
+func ParseNumber(text string) (float64, string, error) {
+	if hexNumber.MatchString(text) {
+		n, _ := new(big.Int).SetString(strings.ReplaceAll(text[2:], "_", ""), 16)
+		value, _ := new(big.Float).SetInt(n).Float64()
+		if math.IsInf(value, 0) {
+			return 0, "", errNumberRange
+		}
+		return value, n.String(), nil
+	}
+
+	m := decimalNumber.FindStringSubmatch(text)
+	if m == nil || m[1] == "" && m[3] == "" {
+		return 0, "", errInvalidNumber
+	}
+	clean := strings.ReplaceAll(text, "_", "")
+	value, err := strconv.ParseFloat(clean, 64)
+	if err != nil {
+		return 0, "", errNumberRange
+	}
+	if value == 0 && strings.ContainsAny(m[1]+m[3], "123456789") {
+		// слишком маленькое: 1e-400
+		return 0, "", errNumberRange
+	}
+	exact, _ := calc.ParseExact(clean)
+	return value, calc.FormatExact(exact), nil
+}
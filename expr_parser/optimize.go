@@ -0,0 +1,304 @@
+package parser
+
+import (
+	"math"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+)
+
+// Options - настройки обработки выражения, которые передаются вместе с ним.
+type Options struct {
+	// убирать тождества вроде x*1, x+0, x*0
+	Simplify bool `json:"simplify"`
+	// вычислять подвыражения из одних чисел сразу, не отправляя вычислителям
+	FoldConstants bool `json:"fold_constants"`
+	// перестраивать цепочки + и * в сбалансированное дерево, чтобы больше
+	// операций считалось параллельно; меняет порядок округлений
+	Rebalance bool `json:"rebalance"`
+	// считать без округлений: числа передаются вычислителям строками,
+	// результат хранится точно в exact_res; fold_constants при этом не работает
+	Exact bool `json:"exact"`
+}
+
+var DefaultOptions = Options{Simplify: true, Rebalance: true}
+
+type optimizer struct {
+	opts  Options
+	folds []db.Fold
+	// имена, которым в скрипте присвоены списки
+	lists map[string]bool
+}
+
+// Optimize упрощает дерево выражения перед компиляцией.
+// Возвращает новое дерево и список сделанных замен.
+func Optimize(node Node, opts Options) (Node, []db.Fold) {
+	return optimize(node, opts, nil)
+}
+
+func optimize(node Node, opts Options, lists map[string]bool) (Node, []db.Fold) {
+	o := optimizer{opts: opts, lists: lists}
+	node = o.visit(node)
+	if opts.Rebalance {
+		node = o.rebalance(node)
+	}
+	return node, o.folds
+}
+
+// OptimizeScript оптимизирует каждую инструкцию скрипта отдельно.
+func OptimizeScript(script []Statement, opts Options) ([]Statement, []db.Fold) {
+	var folds []db.Fold
+	optimized := make([]Statement, len(script))
+	lists := map[string]bool{}
+	for i, statement := range script {
+		var statementFolds []db.Fold
+		optimized[i].Name = statement.Name
+		optimized[i].Expr, statementFolds = optimize(statement.Expr, opts, lists)
+		folds = append(folds, statementFolds...)
+		if statement.Name != "" {
+			lists[statement.Name] = mayBeList(optimized[i].Expr, lists)
+		}
+	}
+	return optimized, folds
+}
+
+func (o *optimizer) record(rule string, before Node, after Node) Node {
+	o.folds = append(o.folds, db.Fold{
+		Rule:   rule,
+		Before: before.String(),
+		After:  after.String(),
+	})
+	return after
+}
+
+func (o *optimizer) visit(node Node) Node {
+	switch n := node.(type) {
+	case *Unary:
+		node = &Unary{Op: n.Op, X: o.visit(n.X)}
+	case *Binary:
+		node = &Binary{Op: n.Op, Left: o.visit(n.Left), Right: o.visit(n.Right)}
+	case *Call:
+		args := make([]Node, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = o.visit(arg)
+		}
+		node = &Call{Name: n.Name, Column: n.Column, Args: args}
+	case *Conditional:
+		node = &Conditional{Cond: o.visit(n.Cond), Then: o.visit(n.Then), Else: o.visit(n.Else)}
+	case *List:
+		elems := make([]Node, len(n.Elems))
+		for i, elem := range n.Elems {
+			elems[i] = o.visit(elem)
+		}
+		node = &List{Elems: elems}
+	}
+
+	if o.opts.FoldConstants && !o.opts.Exact {
+		if value, ok := evaluate(node); ok {
+			return o.record("constant", node, &Literal{Value: value})
+		}
+	}
+	if o.opts.Simplify {
+		if simple, rule := simplify(node, o.lists); simple != nil {
+			return o.record(rule, node, simple)
+		}
+	}
+	return node
+}
+
+// literalValue понимает и знаковые литералы: -5 в дереве - это Unary над Literal
+func literalValue(node Node) (float64, bool) {
+	switch n := node.(type) {
+	case *Literal:
+		return n.Value, true
+	case *Unary:
+		if n.Op == "!" {
+			return 0, false
+		}
+		value, ok := literalValue(n.X)
+		if n.Op == "-" {
+			value = -value
+		}
+		return value, ok
+	}
+	return 0, false
+}
+
+// evaluate вычисляет операцию над числами так же, как это сделал бы вычислитель.
+// Бесконечность и NaN не сворачиваются: у них нет записи числом, а тело
+// свёртки по диапазону уходит вычислителю текстом.
+func evaluate(node Node) (float64, bool) {
+	var oper string
+	var args []Node
+	switch n := node.(type) {
+	case *Binary:
+		oper, args = n.Op, []Node{n.Left, n.Right}
+	case *Call:
+		oper, args = n.Name, n.Args
+	default:
+		return 0, false
+	}
+
+	op, ok := calc.Operations[oper]
+	if !ok {
+		return 0, false
+	}
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		value, ok := literalValue(arg)
+		if !ok {
+			return 0, false
+		}
+		values[i] = value
+	}
+	res := op.Calc(values)
+	return res, !math.IsInf(res, 0) && !math.IsNaN(res)
+}
+
+// mayBeList - значением узла может оказаться список. Что вернёт ссылка
+// на другое выражение, до компиляции неизвестно.
+func mayBeList(node Node, lists map[string]bool) bool {
+	switch n := node.(type) {
+	case *List, *Reference:
+		return true
+	case *Variable:
+		return lists[n.Name]
+	case *Unary:
+		return mayBeList(n.X, lists)
+	case *Binary:
+		return mayBeList(n.Left, lists) || mayBeList(n.Right, lists)
+	case *Call:
+		if listFunctions[n.Name] {
+			return false
+		}
+		for _, arg := range n.Args {
+			if mayBeList(arg, lists) {
+				return true
+			}
+		}
+	case *Conditional:
+		return mayBeList(n.Then, lists) || mayBeList(n.Else, lists)
+	}
+	return false
+}
+
+func simplify(node Node, lists map[string]bool) (Node, string) {
+	n, ok := node.(*Binary)
+	if !ok {
+		return nil, ""
+	}
+	left, leftOk := literalValue(n.Left)
+	right, rightOk := literalValue(n.Right)
+	isLeft := func(x float64) bool { return leftOk && left == x }
+	isRight := func(x float64) bool { return rightOk && right == x }
+
+	switch n.Op {
+	case "+":
+		if isRight(0) {
+			return n.Left, "x + 0"
+		}
+		if isLeft(0) {
+			return n.Right, "0 + x"
+		}
+	case "-":
+		if isRight(0) {
+			return n.Left, "x - 0"
+		}
+	case "*":
+		// список, умноженный на 0, - список нулей, а не 0
+		if (isRight(0) || isLeft(0)) && !mayBeList(n, lists) {
+			return &Literal{Value: 0}, "x * 0"
+		}
+		if isRight(1) {
+			return n.Left, "x * 1"
+		}
+		if isLeft(1) {
+			return n.Right, "1 * x"
+		}
+	case "/":
+		if isRight(1) {
+			return n.Left, "x / 1"
+		}
+	case "^":
+		if isRight(1) {
+			return n.Left, "x ^ 1"
+		}
+	}
+	return nil, ""
+}
+
+// ассоциативные операторы, цепочки которых можно перестраивать
+var associative = map[string]bool{
+	"+": true,
+	"*": true,
+}
+
+// rebalance превращает цепочку 1+2+3+4 из ((1+2)+3)+4 в (1+2)+(3+4):
+// вместо n-1 последовательных операций получается log2(n).
+// Порядок операндов сохраняется.
+func (o *optimizer) rebalance(node Node) Node {
+	switch n := node.(type) {
+	case *Unary:
+		return &Unary{Op: n.Op, X: o.rebalance(n.X)}
+	case *Call:
+		args := make([]Node, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = o.rebalance(arg)
+		}
+		return &Call{Name: n.Name, Column: n.Column, Args: args}
+	case *Conditional:
+		return &Conditional{Cond: o.rebalance(n.Cond), Then: o.rebalance(n.Then), Else: o.rebalance(n.Else)}
+	case *List:
+		elems := make([]Node, len(n.Elems))
+		for i, elem := range n.Elems {
+			elems[i] = o.rebalance(elem)
+		}
+		return &List{Elems: elems}
+	case *Binary:
+		var operands []Node
+		if associative[n.Op] {
+			operands = flatten(n.Op, n, nil)
+		}
+		if len(operands) == 0 || chainDepth(n.Op, n) <= balancedDepth(len(operands)) {
+			return &Binary{Op: n.Op, Left: o.rebalance(n.Left), Right: o.rebalance(n.Right)}
+		}
+		for i, operand := range operands {
+			operands[i] = o.rebalance(operand)
+		}
+		return o.record("rebalance", n, balance(n.Op, operands))
+	}
+	return node
+}
+
+// сколько операций op в цепочке выполняется друг за другом
+func chainDepth(op string, node Node) int {
+	n, ok := node.(*Binary)
+	if !ok || n.Op != op {
+		return 0
+	}
+	return 1 + max(chainDepth(op, n.Left), chainDepth(op, n.Right))
+}
+
+func balancedDepth(operands int) int {
+	depth := 0
+	for size := 1; size < operands; size *= 2 {
+		depth++
+	}
+	return depth
+}
+
+func flatten(op string, node Node, operands []Node) []Node {
+	if n, ok := node.(*Binary); ok && n.Op == op {
+		operands = flatten(op, n.Left, operands)
+		return flatten(op, n.Right, operands)
+	}
+	return append(operands, node)
+}
+
+func balance(op string, operands []Node) Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	mid := len(operands) / 2
+	return &Binary{Op: op, Left: balance(op, operands[:mid]), Right: balance(op, operands[mid:])}
+}
@@ -3,189 +3,782 @@ package parser
 import (
 	"context"
 	sql "database/sql"
+	"errors"
 	"fmt"
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
 	pb "github.com/Zheleznov-Fedor/new-ya-long-calc/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
-	"regexp"
+	"google.golang.org/grpc/status"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	db "github.com/Zheleznov-Fedor/new-ya-long-calc/db"
 	"github.com/Zheleznov-Fedor/new-ya-long-calc/utils"
 )
 
-func SplitHumanExpressionToTokens(expression string) []string {
-	re := regexp.MustCompile(`(\d+\.\d+|\d+|\+|-|\*|/)`)
-	return re.FindAllString(expression, -1)
+type operator struct {
+	precedence int
+	rightAssoc bool
 }
 
-func TokensToRPN(tokens []string) utils.Queue {
-	precedence := map[string]int{
-		"+": 1,
-		"-": 1,
-		"*": 2,
-		"/": 2,
+var operators = map[string]operator{
+	"||": {1, false},
+	"&&": {2, false},
+	"==": {3, false},
+	"!=": {3, false},
+	"<":  {4, false},
+	"<=": {4, false},
+	">":  {4, false},
+	">=": {4, false},
+	"+":  {5, false},
+	"-":  {5, false},
+	"*":  {6, false},
+	"/":  {6, false},
+	"%":  {6, false},
+	"//": {6, false},
+	"^":  {8, true},
+}
+
+// унарные операторы связывают сильнее * и /, но слабее ^: -2^2 = -(2^2)
+var unaryOperator = operator{unaryPrecedence, true}
+
+// c ? a : b связывает слабее всех и правоассоциативен: a ? b : c ? d : e = a ? b : (c ? d : e)
+var ternaryOperator = operator{ternaryPrecedence, true}
+
+func tokenOperator(t Token) (operator, bool) {
+	switch t.Kind {
+	case TokenUnary:
+		return unaryOperator, true
+	case TokenOperator:
+		return operators[t.Text], true
+	case TokenColon:
+		// на стеке ":" заменяет "?" и означает весь условный оператор
+		return ternaryOperator, true
 	}
+	return operator{}, false
+}
 
-	var output utils.Queue
-	var operators utils.Stack
+// maxArgs == -1 - функция принимает сколько угодно аргументов
+type function struct {
+	minArgs int
+	maxArgs int
+}
+
+var functions = map[string]function{
+	"sqrt": {1, 1},
+	"abs":  {1, 1},
+	"min":  {1, -1},
+	"max":  {1, -1},
+	"log":  {1, 2},
+	// if(c, a, b) - то же, что c ? a : b
+	"if":    {3, 3},
+	"round": {1, 1},
+	"floor": {1, 1},
+	"ceil":  {1, 1},
+	"trunc": {1, 1},
+	// функции от списков: сумма, произведение, среднее, скалярное произведение и длина.
+	// sum и product с четырьмя аргументами - свёртка по диапазону, см. rangeFunctions
+	"sum":     {1, 4},
+	"product": {1, 4},
+	"avg":     {1, 1},
+	"dot":     {2, 2},
+	"len":     {1, 1},
+}
 
-	for _, token := range tokens {
-		if _, ok := precedence[token]; ok {
-			for !operators.IsEmpty() && precedence[operators.Head()] >= precedence[token] {
-				output.Put(operators.Pop())
+func wrongArgc(argc int) string {
+	return fmt.Sprintf("wrong number of arguments (%d) for function", argc)
+}
+
+// TokensToRPN проверяет порядок токенов и переставляет их в обратную польскую запись.
+// Вызов функции попадает в результат токеном с именем функции и заполненным Argc,
+// список - токеном "[" с числом элементов в Argc.
+func TokensToRPN(tokens []Token) (utils.Queue[Token], error) {
+	var output utils.Queue[Token]
+	var stack utils.Stack[Token]
+	// для каждой открытой скобки: -1 - обычная группировка,
+	// иначе - сколько аргументов уже встретилось в вызове функции
+	// или элементов в списке
+	var argCounts []int
+	expectOperand := true
+
+	for i, token := range tokens {
+		switch token.Kind {
+		case TokenNumber, TokenReference:
+			if !expectOperand {
+				if token.Kind == TokenReference {
+					return nil, newSyntaxError("unexpected reference", token)
+				}
+				return nil, newSyntaxError("unexpected number", token)
 			}
-			operators.Push(token)
-		} else {
 			output.Put(token)
+			expectOperand = false
+		case TokenUnary:
+			if !expectOperand {
+				return nil, newSyntaxError("unexpected operator", token)
+			}
+			// префиксный оператор: левого операнда нет, выталкивать нечего
+			stack.Push(token)
+		case TokenOperator:
+			if expectOperand {
+				return nil, newSyntaxError("unexpected operator", token)
+			}
+			op := operators[token.Text]
+			for !stack.IsEmpty() {
+				head, ok := tokenOperator(stack.Head())
+				if !ok || head.precedence < op.precedence ||
+					head.precedence == op.precedence && op.rightAssoc {
+					break
+				}
+				output.Put(stack.Pop())
+			}
+			stack.Push(token)
+			expectOperand = true
+		case TokenIdent:
+			if !expectOperand {
+				return nil, newSyntaxError("unexpected identifier", token)
+			}
+			// вызов неизвестной функции - возможно, функции пользователя,
+			// их подставляет ExpandFunctions
+			isCall := i+1 < len(tokens) && tokens[i+1].Kind == TokenLParen
+			_, isFunction := functions[token.Text]
+			if !isCall && isFunction {
+				return nil, newSyntaxError("missing '(' after function", token)
+			}
+			if !isCall {
+				token.Kind = TokenVariable
+				output.Put(token)
+				expectOperand = false
+				continue
+			}
+			stack.Push(token)
+		case TokenLParen:
+			if !expectOperand {
+				return nil, newSyntaxError("unexpected '('", token)
+			}
+			stack.Push(token)
+			argc := -1
+			if i > 0 && tokens[i-1].Kind == TokenIdent {
+				argc = 1
+				if i+1 < len(tokens) && tokens[i+1].Kind == TokenRParen {
+					argc = 0
+				}
+			}
+			argCounts = append(argCounts, argc)
+		case TokenLBracket:
+			if !expectOperand {
+				return nil, newSyntaxError("unexpected '['", token)
+			}
+			if i+1 < len(tokens) && tokens[i+1].Kind == TokenRBracket {
+				return nil, newSyntaxError("empty list", token)
+			}
+			stack.Push(token)
+			argCounts = append(argCounts, 1)
+		case TokenComma:
+			if expectOperand {
+				return nil, newSyntaxError("missing argument before ','", token)
+			}
+			for !stack.IsEmpty() && stack.Head().Kind != TokenLParen && stack.Head().Kind != TokenLBracket {
+				if stack.Head().Kind == TokenQuestion {
+					return nil, newSyntaxError("missing ':' after", stack.Head())
+				}
+				output.Put(stack.Pop())
+			}
+			if stack.IsEmpty() || argCounts[len(argCounts)-1] == -1 {
+				return nil, newSyntaxError("unexpected ',' outside of function call", token)
+			}
+			argCounts[len(argCounts)-1]++
+			expectOperand = true
+		case TokenRParen:
+			emptyCall := len(argCounts) > 0 && argCounts[len(argCounts)-1] == 0
+			if expectOperand && !emptyCall {
+				return nil, newSyntaxError("unexpected ')'", token)
+			}
+			for !stack.IsEmpty() && stack.Head().Kind != TokenLParen && stack.Head().Kind != TokenLBracket {
+				if stack.Head().Kind == TokenQuestion {
+					return nil, newSyntaxError("missing ':' after", stack.Head())
+				}
+				output.Put(stack.Pop())
+			}
+			if stack.IsEmpty() || stack.Head().Kind == TokenLBracket {
+				return nil, newSyntaxError("mismatched brackets: unexpected ')'", token)
+			}
+			stack.Pop()
+			argc := argCounts[len(argCounts)-1]
+			argCounts = argCounts[:len(argCounts)-1]
+			expectOperand = false
+			if argc == -1 {
+				continue
+			}
+			name := stack.Pop()
+			f, ok := functions[name.Text]
+			_, ranged := rangeFunctions[name.Text]
+			if ok && (argc < f.minArgs || f.maxArgs != -1 && argc > f.maxArgs || ranged && argc != 1 && argc != 4) {
+				return nil, newSyntaxError(wrongArgc(argc), name)
+			}
+			name.Argc = argc
+			output.Put(name)
+		case TokenRBracket:
+			if expectOperand {
+				return nil, newSyntaxError("unexpected ']'", token)
+			}
+			for !stack.IsEmpty() && stack.Head().Kind != TokenLParen && stack.Head().Kind != TokenLBracket {
+				if stack.Head().Kind == TokenQuestion {
+					return nil, newSyntaxError("missing ':' after", stack.Head())
+				}
+				output.Put(stack.Pop())
+			}
+			if stack.IsEmpty() || stack.Head().Kind == TokenLParen {
+				return nil, newSyntaxError("mismatched brackets: unexpected ']'", token)
+			}
+			list := stack.Pop()
+			list.Argc = argCounts[len(argCounts)-1]
+			argCounts = argCounts[:len(argCounts)-1]
+			output.Put(list)
+			expectOperand = false
+		case TokenQuestion:
+			if expectOperand {
+				return nil, newSyntaxError("unexpected '?'", token)
+			}
+			for !stack.IsEmpty() {
+				head, ok := tokenOperator(stack.Head())
+				if !ok || head.precedence <= ternaryPrecedence {
+					break
+				}
+				output.Put(stack.Pop())
+			}
+			stack.Push(token)
+			expectOperand = true
+		case TokenColon:
+			if expectOperand {
+				return nil, newSyntaxError("unexpected ':'", token)
+			}
+			for !stack.IsEmpty() && stack.Head().Kind != TokenQuestion && stack.Head().Kind != TokenLParen &&
+				stack.Head().Kind != TokenLBracket {
+				output.Put(stack.Pop())
+			}
+			if stack.IsEmpty() || stack.Head().Kind != TokenQuestion {
+				return nil, newSyntaxError("unexpected ':'", token)
+			}
+			stack.Pop()
+			stack.Push(token)
+			expectOperand = true
+		case TokenAssign:
+			return nil, newSyntaxError("unexpected '='", token)
+		case TokenSemicolon:
+			return nil, newSyntaxError("unexpected ';'", token)
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, &SyntaxError{Msg: "empty expression", Column: 1}
+	}
+	if expectOperand {
+		last := tokens[len(tokens)-1]
+		return nil, &SyntaxError{
+			Msg:    "unexpected end of expression",
+			Column: last.Column + len([]rune(last.Text)),
 		}
 	}
 
-	for !operators.IsEmpty() {
-		output.Put(operators.Pop())
+	for !stack.IsEmpty() {
+		if stack.Head().Kind == TokenLParen {
+			return nil, newSyntaxError("mismatched brackets: missing ')'", stack.Head())
+		}
+		if stack.Head().Kind == TokenLBracket {
+			return nil, newSyntaxError("mismatched brackets: missing ']'", stack.Head())
+		}
+		if stack.Head().Kind == TokenQuestion {
+			return nil, newSyntaxError("missing ':' after", stack.Head())
+		}
+		output.Put(stack.Pop())
+	}
+
+	return output, nil
+}
+
+// RPNToAST собирает дерево выражения из обратной польской записи,
+// полученной из TokensToRPN.
+func RPNToAST(rpn utils.Queue[Token]) Node {
+	var nodes utils.Stack[Node]
+
+	for !rpn.IsEmpty() {
+		token := rpn.Get()
+		switch token.Kind {
+		case TokenNumber:
+			value, exact, _ := ParseNumber(token.Text)
+			nodes.Push(&Literal{Value: value, Text: exact})
+		case TokenVariable:
+			nodes.Push(&Variable{Name: token.Text, Column: token.Column})
+		case TokenReference:
+			id, _ := strconv.ParseInt(token.Text[1:], 10, 64)
+			nodes.Push(&Reference{ExprId: id, Column: token.Column})
+		case TokenUnary:
+			nodes.Push(&Unary{Op: token.Text, X: nodes.Pop()})
+		case TokenOperator:
+			right := nodes.Pop()
+			left := nodes.Pop()
+			nodes.Push(&Binary{Op: token.Text, Left: left, Right: right})
+		case TokenColon:
+			els := nodes.Pop()
+			then := nodes.Pop()
+			nodes.Push(&Conditional{Cond: nodes.Pop(), Then: then, Else: els})
+		case TokenIdent:
+			args := make([]Node, token.Argc)
+			for i := token.Argc - 1; i >= 0; i-- {
+				args[i] = nodes.Pop()
+			}
+			if token.Text == "if" {
+				nodes.Push(&Conditional{Cond: args[0], Then: args[1], Else: args[2]})
+				continue
+			}
+			nodes.Push(&Call{Name: token.Text, Args: args, Column: token.Column})
+		case TokenLBracket:
+			elems := make([]Node, token.Argc)
+			for i := token.Argc - 1; i >= 0; i-- {
+				elems[i] = nodes.Pop()
+			}
+			nodes.Push(&List{Elems: elems})
+		}
 	}
 
-	return output
+	return nodes.Pop()
 }
 
-func StrToFloat64(s string) float64 {
-	val, _ := strconv.ParseFloat(s, 64)
-	return float64(val)
+// Parse разбирает текст выражения в дерево.
+func Parse(expression string) (Node, error) {
+	tokens, err := SplitHumanExpressionToTokens(expression)
+	if err != nil {
+		return nil, err
+	}
+	rpn, err := TokensToRPN(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return RPNToAST(rpn), nil
 }
 
-func SplitRPNToComputations(tokens utils.Queue, expr string, userId int64) (int64, []int64) {
+// SavePlan записывает выражение и его операции в базу одной транзакцией:
+// до её завершения ни одну операцию нельзя отправить вычислителю.
+// Из expr берутся текст выражения, пользователь и значения переменных.
+// Возвращает id выражения и id операций, которые можно сразу отправлять вычислителям.
+func SavePlan(plan Plan, folds []db.Fold, expr db.Expression) (int64, []int64) {
 	ctx := context.TODO()
-	var nums utils.Stack
 	var ready_opers_ids []int64
-	var left_link, right_link string
-	var left, right float64
-	var leftSenderOperID, rightSenderOperID int
-	var operID int64
-	state := "created"
-	leftSenderOperID, rightSenderOperID = 0, 0
+	// рёбра от операций других выражений
+	var externalEdges []db.Edge
 
-	d, err := sql.Open("sqlite3", "./db/expressions.db")
+	conn := openDB(ctx)
+	defer conn.Close()
+	d, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		panic(err)
 	}
-	defer d.Close()
+	defer d.Rollback()
 
-	err = d.PingContext(ctx)
+	expr.State = "calculating"
+	exprID, err := db.InsertExpression(ctx, d, &expr)
 	if err != nil {
 		panic(err)
 	}
 
-	exprID, err := db.InsertExpression(ctx, d, &db.Expression{
-		UserId: userId,
-		Expr:   expr,
-		State:  "calculating",
-	})
-	if err != nil {
-		panic(err)
+	for _, f := range folds {
+		err = db.InsertFold(ctx, d, exprID, f)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	for !tokens.IsEmpty() {
-		token := tokens.Get()
-		state = "created"
+	// точные значения чисел записываются только в точном режиме
+	exact := func(arg PlannedArg) string {
+		if expr.Exact {
+			return arg.Exact
+		}
+		return ""
+	}
 
-		if strings.Contains("+-*/", token) {
-			left, right = 0, 0
-			right_link = nums.Pop()
-			if right_link[0] != '@' {
-				right = StrToFloat64(right_link)
-				right_link = ""
-			} else {
-				leftSenderOperID, _ = strconv.Atoi(right_link[1:])
-			}
-			left_link = nums.Pop()
-			if left_link[0] != '@' {
-				left = StrToFloat64(left_link)
-				left_link = ""
+	operIDs := make([]int64, len(plan.Operations))
+	for i, planned := range plan.Operations {
+		oper := db.Operation{
+			ExprId: exprID,
+			Oper:   planned.Oper,
+			State:  "created",
+			Exact:  expr.Exact,
+			Length: int64(planned.Len),
+			Start:  int64(planned.Start),
+			End:    int64(planned.End),
+			Body:   planned.Body,
+			Params: planned.Params,
+		}
+		for _, arg := range planned.Args {
+			if arg.IsLiteral() {
+				oper.Args = append(oper.Args, db.Operand{Value: arg.Value, Exact: exact(arg), List: arg.List, Ready: true})
 			} else {
-				rightSenderOperID, _ = strconv.Atoi(left_link[1:])
-			}
-
-			if leftSenderOperID != 0 {
-				state = "waiting_for_right"
+				oper.Args = append(oper.Args, db.Operand{})
+				oper.Waiting++
 			}
-			if rightSenderOperID != 0 {
-				if state == "waiting_for_right" {
-					state = "waiting_for_left&right"
-				} else {
-					state = "waiting_for_left"
-				}
-			}
-			oper := db.Operation{
-				ExprId: exprID,
-				A:      left,
-				B:      right,
-				Oper:   token,
-				State:  state,
+		}
+		// операция в ветке ждёт ещё и условие
+		oper.Waiting += int64(len(planned.BranchGuards()))
+		if oper.Waiting > 0 {
+			oper.State = "waiting"
+		}
+		operIDs[i], err = db.InsertOperation(ctx, d, &oper)
+		if err != nil {
+			panic(err)
+		}
+		if oper.State == "created" {
+			ready_opers_ids = append(ready_opers_ids, operIDs[i])
+		}
+		// аргументы всегда записаны раньше операции, которая их ждёт
+		for argNum, arg := range planned.Args {
+			if arg.IsLiteral() {
+				continue
 			}
-			operID, err = db.InsertOperation(ctx, d, &oper)
-			if state == "created" {
-				ready_opers_ids = append(ready_opers_ids, operID)
+			if arg.IsExternal() {
+				externalEdges = append(externalEdges, db.Edge{From: arg.External, To: operIDs[i], Arg: int64(argNum)})
+				continue
 			}
+			err = db.InsertEdge(ctx, d, db.Edge{From: operIDs[arg.From], To: operIDs[i], Arg: int64(argNum)})
 			if err != nil {
 				panic(err)
 			}
-			if leftSenderOperID != 0 {
-				db.SetOperationNotification(ctx, d, int64(leftSenderOperID), operID, "right")
-			}
-			if rightSenderOperID != 0 {
-				db.SetOperationNotification(ctx, d, int64(rightSenderOperID), operID, "left")
+		}
+		for _, g := range planned.Guards {
+			err = db.InsertGuard(ctx, d, db.Guard{
+				Condition: operIDs[g.Operation],
+				Oper:      operIDs[i],
+				Branch:    g.Then,
+				Arg:       int64(g.Arg),
+			})
+			if err != nil {
+				panic(err)
 			}
-			leftSenderOperID, rightSenderOperID = 0, 0
-			nums.Push("@" + strconv.Itoa(int(operID)))
+		}
+	}
+
+	for i, name := range plan.Names {
+		v := db.Value{Name: name.Name}
+		if name.Arg.IsLiteral() && name.Arg.List != nil {
+			v.List = name.Arg.List
+		} else if name.Arg.IsLiteral() {
+			v.Res = sql.NullFloat64{Float64: name.Arg.Value, Valid: true}
+			v.ExactRes = sql.NullString{String: exact(name.Arg), Valid: exact(name.Arg) != ""}
+		} else if name.Arg.IsExternal() {
+			v.OperId = sql.NullInt64{Int64: name.Arg.External, Valid: true}
 		} else {
-			nums.Push(token)
+			v.OperId = sql.NullInt64{Int64: operIDs[name.Arg.From], Valid: true}
+		}
+		err = db.InsertValue(ctx, d, exprID, i, v)
+		if err != nil {
+			panic(err)
 		}
 	}
 
-	err = db.MakeOperationFinal(ctx, d, operID)
+	if plan.Result.IsLiteral() {
+		// результат известен без вычислителей, например "(5)" или "x = 2*3; 5"
+		err = db.SetExpressionResult(ctx, d, exprID, plan.Result.Value, exact(plan.Result), plan.Result.List)
+	} else {
+		err = db.MakeOperationFinal(ctx, d, operIDs[plan.Result.From])
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	// рёбра от других выражений записываются последними: как только ребро
+	// появится, по нему может прийти результат, и выражение должно быть готово его принять
+	for _, e := range externalEdges {
+		err = db.InsertEdge(ctx, d, e)
+		if err != nil {
+			panic(err)
+		}
+		// операция могла посчитаться до записи ребра, тогда результат
+		// по нему никто не разошлёт - забираем его сами
+		sender, err := db.SelectOperationById(ctx, d, e.From)
+		if err != nil {
+			panic(err)
+		}
+		if sender.State == "failed" {
+			// выражение, на которое ссылаемся, успело завершиться ошибкой
+			err = db.SetExpressionFailed(ctx, d, exprID, fmt.Sprintf("referenced expression $%d failed", sender.ExprId))
+			if err != nil {
+				panic(err)
+			}
+			continue
+		}
+		if sender.State != "calculated" {
+			continue
+		}
+		ready, err := db.SetOperationArg(ctx, d, e.To, e.Arg, sender.Res.Float64, sender.ExactRes.String, sender.ResList)
+		if err != nil {
+			panic(err)
+		}
+		if ready {
+			ready_opers_ids = append(ready_opers_ids, e.To)
+		}
+	}
+
+	err = d.Commit()
+	if err != nil {
+		panic(err)
+	}
 	return exprID, ready_opers_ids
 }
 
-func BuildOperations(expression string, userId int64) (int64, []int64) {
-	return SplitRPNToComputations(TokensToRPN(SplitHumanExpressionToTokens(expression)), expression, userId)
+func openDB(ctx context.Context) *sql.DB {
+	d, err := sql.Open("sqlite3", "./db/expressions.db")
+	if err != nil {
+		panic(err)
+	}
+
+	err = d.PingContext(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return d
 }
 
+// BuiltPlan - граф операций выражения, ещё не сохранённый в базу.
+type BuiltPlan struct {
+	Plan
+	Folds []db.Fold
+	// выражение в каноническом виде, см. FormatScript
+	Canonical string
+	// в выражении вызываются функции пользователя
+	WithFunctions bool
+}
+
+// BuildPlan разбирает скрипт (или одно выражение), подставляет функции
+// пользователя и ссылки, оптимизирует и разбивает на операции, но ничего
+// не сохраняет.
+func BuildPlan(ctx context.Context, d *sql.DB, expression string, vars map[string]float64, userId int64, opts Options) (BuiltPlan, error) {
+	var built BuiltPlan
+	script, err := ParseScript(expression)
+	if err != nil {
+		return built, err
+	}
+	built.Canonical = FormatScript(script)
+	funcs, err := LoadFunctions(ctx, d, userId)
+	if err != nil {
+		return built, err
+	}
+	script, err = ExpandFunctions(script, funcs)
+	if err != nil {
+		return built, err
+	}
+	built.WithFunctions = FormatScript(script) != built.Canonical
+	// проверять нужно до оптимизации, см. CheckUnbound
+	err = CheckUnbound(script, vars)
+	if err != nil {
+		return built, err
+	}
+	refs, err := ResolveReferences(ctx, d, script, userId)
+	if err != nil {
+		return built, err
+	}
+	script, built.Folds = OptimizeScript(script, opts)
+	built.Plan, err = Compile(script, vars, refs)
+	return built, err
+}
+
+// BuildOperations строит граф операций выражения (см. BuildPlan) и сохраняет
+// его. Возвращает id выражения и id готовых к вычислению операций.
+// Если пользователь уже отправлял такое же выражение (с точностью до записи,
+// см. FormatScript) с теми же переменными и настройками, возвращает id того выражения.
+func BuildOperations(expression string, vars map[string]float64, userId int64, opts Options) (int64, []int64, error) {
+	ctx := context.TODO()
+	d := openDB(ctx)
+	defer d.Close()
+	built, err := BuildPlan(ctx, d, expression, vars, userId, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	expr := db.Expression{
+		UserId:    userId,
+		Expr:      expression,
+		Vars:      vars,
+		Exact:     opts.Exact,
+		Canonical: built.Canonical,
+		// с другими настройками граф и округления другие, это уже не дубликат
+		Simplify:      opts.Simplify,
+		FoldConstants: opts.FoldConstants,
+		Rebalance:     opts.Rebalance,
+	}
+	// то же выражение уже отправлялось - второй раз его не считаем.
+	// Функцию пользователя могли с тех пор переопределить, поэтому выражения
+	// с ними считаются заново.
+	if !built.WithFunctions {
+		duplicate, err := db.SelectDuplicateExpression(ctx, d, expr)
+		if err == nil {
+			return duplicate.Id, nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, err
+		}
+	}
+	exprID, readyOperIDs := SavePlan(built.Plan, built.Folds, expr)
+	return exprID, readyOperIDs, nil
+}
+
+// workersV1 - адреса вычислителей, которые не знают OperationServiceV2,
+// и когда это выяснилось. Пока вычислители обновляются, к таким сразу идём
+// по старой версии, а через workerV1TTL снова пробуем вторую: вычислитель
+// за этим адресом могли обновить.
+var workersV1 sync.Map
+
+const workerV1TTL = time.Minute
+
+func isWorkerV1(addr string) bool {
+	since, ok := workersV1.Load(addr)
+	if !ok {
+		return false
+	}
+	if time.Since(since.(time.Time)) > workerV1TTL {
+		workersV1.Delete(addr)
+		return false
+	}
+	return true
+}
+
+// nextWorker выбирает следующего по кругу вычислителя. Если нужна вторая
+// версия сервиса, пропускает тех, кто её не знает; false - таких нет.
+func nextWorker(needsV2 bool) (string, bool) {
+	for i := 0; i < max(utils.Port.Cnt, 1); i++ {
+		addr := fmt.Sprintf("%s:%s", "localhost", utils.Port.GetValue())
+		if !needsV2 || !isWorkerV1(addr) {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// retryDelay - пауза перед повторной отправкой операции, которую не удалось
+// доставить: удваивается с каждой попыткой, но не больше maxRetryDelay
+func retryDelay(attempt int) time.Duration {
+	const minRetryDelay, maxRetryDelay = 100 * time.Millisecond, 10 * time.Second
+	if attempt >= 7 {
+		return maxRetryDelay
+	}
+	return min(minRetryDelay<<attempt, maxRetryDelay)
+}
+
+// retryable - ошибка связи с вычислителем, операцию стоит отправить ещё раз.
+// Остальные ошибки (неверные аргументы, операция, которую вычислитель не
+// умеет) повторятся и при следующей отправке.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// SendTask отправляет операцию вычислителю и передаёт результат дальше по графу.
 func SendTask(ctx context.Context, d *sql.DB, oper db.Operation) {
-	host := "localhost"
-	port := utils.Port.GetValue()
+	sendTask(ctx, d, oper, 0)
+}
+
+func sendTask(ctx context.Context, d *sql.DB, oper db.Operation, attempt int) {
+	args := make([]float64, len(oper.Args))
+	exactArgs := make([]string, len(oper.Args))
+	// списки передаются, только если они есть
+	var lists []*pb.ListArg
+	_, withLists := calc.ListOperations[oper.Oper]
+	for _, list := range oper.SliceArgs() {
+		if list != nil {
+			withLists = true
+		}
+		lists = append(lists, &pb.ListArg{Values: list})
+	}
+	if !withLists {
+		lists = nil
+	}
+	for i, arg := range oper.Args {
+		args[i] = arg.Value
+		exactArgs[i] = arg.Exact
+		if arg.Exact == "" {
+			// хотя бы один аргумент известен неточно - точный результат не получится
+			oper.Exact = false
+		}
+	}
+	if !oper.Exact {
+		exactArgs = nil
+	}
+	// списки и свёртки по диапазону умеет считать только OperationServiceV2
+	_, ranged := calc.RangeOperations[oper.Oper]
+	needsV2 := withLists || ranged
 
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%s", host, port),
+	addr, ok := nextWorker(needsV2)
+	if !ok {
+		// все вычислители пока старые: ждём, пока какой-нибудь обновят,
+		// это не ошибка связи, и попытка не засчитывается
+		time.AfterFunc(retryDelay(attempt), func() {
+			sendTask(ctx, d, oper, attempt)
+		})
+		return
+	}
+	conn, err := grpc.Dial(addr,
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		panic(err)
 	}
 	defer conn.Close()
 
-	grpcClient := pb.NewOperationServiceClient(conn)
-
-	res, err := grpcClient.Calc(context.TODO(), &pb.OperationRequest{
-		Id:   int32(oper.Id),
-		A:    float32(oper.A),
-		B:    float32(oper.B),
-		Oper: oper.Oper,
-	})
+	var res *pb.OperationResultV2
+	start := time.Now()
+	if isWorkerV1(addr) {
+		res, err = calcV1(conn, oper, args, exactArgs)
+	} else {
+		res, err = pb.NewOperationServiceV2Client(conn).Calc(context.TODO(), &pb.OperationRequestV2{
+			Id:        int32(oper.Id),
+			Oper:      oper.Oper,
+			Args:      args,
+			ExactArgs: exactArgs,
+			Lists:     lists,
+			Body:      oper.Body,
+			Params:    oper.Params,
+		})
+		if status.Code(err) == codes.Unimplemented {
+			workersV1.Store(addr, time.Now())
+			if needsV2 {
+				// операцию посчитает другой вычислитель, этот больше не выберется
+				go sendTask(ctx, d, oper, attempt)
+				return
+			}
+			res, err = calcV1(conn, oper, args, exactArgs)
+		}
+	}
+	if retryable(err) {
+		time.AfterFunc(retryDelay(attempt), func() {
+			sendTask(ctx, d, oper, attempt+1)
+		})
+		return
+	}
 	if err != nil {
-		go func() {
-			SendTask(ctx, d, oper)
-		}()
+		failOperation(ctx, d, oper, err)
 		return
 	}
 
+	result := res.Result
+	if exact, ok := calc.ParseExact(res.ExactResult); ok {
+		result, _ = exact.Float64()
+	}
+	var list []float64
+	if len(res.ListResult) > 0 {
+		list = res.ListResult
+	}
+
 	err = db.ExprOperationCalculated(ctx, d, oper.ExprId)
 	if err != nil {
 		panic(err)
 	}
-	err = db.SetOperationRes(ctx, d, oper.Id, float64(res.Result))
+	err = db.SetOperationRes(ctx, d, oper.Id, result, res.ExactResult, list)
+	if err != nil {
+		panic(err)
+	}
+	err = db.SetOperationTrace(ctx, d, oper.Id, addr, time.Since(start))
 	if err != nil {
 		panic(err)
 	}
@@ -195,39 +788,127 @@ func SendTask(ctx context.Context, d *sql.DB, oper db.Operation) {
 	}
 
 	if oper.Final == 1 {
-		err := db.SetExpressionResult(ctx, d, oper.ExprId, float64(res.Result))
+		err := db.SetExpressionResult(ctx, d, oper.ExprId, result, res.ExactResult, list)
 		if err != nil {
 			panic(err)
 		}
+	}
+
+	edges, err := db.SelectEdgesFrom(ctx, d, oper.Id)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range edges {
+		DeliverResult(ctx, d, e, result, res.ExactResult, list)
+	}
+
+	guards, err := db.SelectGuardsByCondition(ctx, d, oper.Id)
+	if err != nil {
+		panic(err)
+	}
+	for _, g := range guards {
+		ResolveGuard(ctx, d, g, result != 0)
+	}
+}
+
+// failOperation отмечает операцию и её выражение несчитаемыми: операции,
+// которые ждут её результат, так и не будут отправлены, поэтому несчитаемыми
+// становятся и выражения, которые на него ссылаются.
+func failOperation(ctx context.Context, d *sql.DB, oper db.Operation, cause error) {
+	msg := cause.Error()
+	if s, ok := status.FromError(cause); ok {
+		msg = s.Message()
+	}
+	err := db.SetOperationState(ctx, d, oper.Id, "failed")
+	if err != nil {
+		panic(err)
+	}
+	failExpression(ctx, d, oper.ExprId, msg, map[int64]bool{})
+}
+
+// failExpression отмечает выражение несчитаемым вместе со всеми выражениями,
+// которые на него ссылаются
+func failExpression(ctx context.Context, d *sql.DB, id int64, msg string, failed map[int64]bool) {
+	if failed[id] {
 		return
 	}
+	failed[id] = true
+	err := db.SetExpressionFailed(ctx, d, id, msg)
+	if err != nil {
+		panic(err)
+	}
+	dependents, err := db.SelectDependentExpressions(ctx, d, id)
+	if err != nil {
+		panic(err)
+	}
+	for _, dependent := range dependents {
+		failExpression(ctx, d, dependent, fmt.Sprintf("referenced expression $%d failed", id), failed)
+	}
+}
 
-	if oper.NotifyOperationId != 0 {
-		err := db.SetOperationNum(ctx, d, oper.NotifyOperationId, oper.NotifyOperationSide, float64(res.Result))
-		if err != nil {
-			panic(err)
-		}
-		receiverOper, err := db.SelectOperationById(ctx, d, oper.NotifyOperationId)
-		if err != nil {
-			panic(err)
-		}
-		if receiverOper.State == "waiting_for_left&right" {
-			if oper.NotifyOperationSide == "right" {
-				err = db.SetOperationState(ctx, d, oper.NotifyOperationId, "waiting_for_left")
-			} else {
-				err = db.SetOperationState(ctx, d, oper.NotifyOperationId, "waiting_for_right")
-			}
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			err = db.SetOperationState(ctx, d, oper.NotifyOperationId, "ready_to_calc")
-			if err != nil {
-				panic(err)
-			}
-			go func() {
-				SendTask(ctx, d, receiverOper)
-			}()
-		}
+// calcV1 отправляет операцию по первой версии сервиса, где числа - float
+func calcV1(conn *grpc.ClientConn, oper db.Operation, args []float64, exactArgs []string) (*pb.OperationResultV2, error) {
+	req := &pb.OperationRequest{
+		Id:        int32(oper.Id),
+		Oper:      oper.Oper,
+		ExactArgs: exactArgs,
+	}
+	for _, arg := range args {
+		req.Args = append(req.Args, float32(arg))
+	}
+	// старые вычислители знают только про a и b
+	if len(req.Args) > 0 {
+		req.A = req.Args[0]
+	}
+	if len(req.Args) > 1 {
+		req.B = req.Args[1]
+	}
+	res, err := pb.NewOperationServiceClient(conn).Calc(context.TODO(), req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.OperationResultV2{
+		Id:          res.Id,
+		Result:      float64(res.Result),
+		ExactResult: res.ExactResult,
+	}, nil
+}
+
+// DeliverResult передаёт результат (его точное значение, если оно есть,
+// или результат-список) по ребру и, если получатель дождался всех аргументов,
+// отправляет его вычислителю.
+func DeliverResult(ctx context.Context, d *sql.DB, e db.Edge, res float64, exact string, list []float64) {
+	ready, err := db.SetOperationArg(ctx, d, e.To, e.Arg, res, exact, list)
+	if err != nil {
+		panic(err)
+	}
+	if !ready {
+		return
+	}
+	receiverOper, err := db.SelectOperationById(ctx, d, e.To)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		SendTask(ctx, d, receiverOper)
+	}()
+}
+
+// ResolveGuard сообщает операции, какую ветку выбрало условие,
+// и отправляет её вычислителю, если больше ей ждать нечего.
+func ResolveGuard(ctx context.Context, d *sql.DB, g db.Guard, branch bool) {
+	ready, err := db.ResolveGuard(ctx, d, g, branch)
+	if err != nil {
+		panic(err)
+	}
+	if !ready {
+		return
+	}
+	oper, err := db.SelectOperationById(ctx, d, g.Oper)
+	if err != nil {
+		panic(err)
 	}
+	go func() {
+		SendTask(ctx, d, oper)
+	}()
 }
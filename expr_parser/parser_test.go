@@ -0,0 +1,670 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+)
+
+// tree записывает дерево со всеми скобками: 1 + 2 * 3 -> (+ 1 (* 2 3))
+func tree(node Node) string {
+	switch n := node.(type) {
+	case *Unary:
+		return "(" + n.Op + " " + tree(n.X) + ")"
+	case *Binary:
+		return "(" + n.Op + " " + tree(n.Left) + " " + tree(n.Right) + ")"
+	case *Conditional:
+		return "(? " + tree(n.Cond) + " " + tree(n.Then) + " " + tree(n.Else) + ")"
+	case *Call:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = tree(arg)
+		}
+		return "(" + n.Name + " " + strings.Join(args, " ") + ")"
+	case *List:
+		elems := make([]string, len(n.Elems))
+		for i, elem := range n.Elems {
+			elems[i] = tree(elem)
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	}
+	return node.String()
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "(+ 1 (* 2 3))"},
+		{"(1 + 2) * 3", "(* (+ 1 2) 3)"},
+		{"1 - 2 - 3", "(- (- 1 2) 3)"},
+		{"8 / 4 / 2", "(/ (/ 8 4) 2)"},
+		{"2 ^ 3 ^ 2", "(^ 2 (^ 3 2))"},
+		{"-2 ^ 2", "(- (^ 2 2))"},
+		{"2 ^ -1", "(^ 2 (- 1))"},
+		{"-x * 3", "(* (- x) 3)"},
+		{"2 * -x", "(* 2 (- x))"},
+		{"--x", "(- (- x))"},
+		{"+x", "(+ x)"},
+		{"7 % 3 * 2", "(* (% 7 3) 2)"},
+		{"7 // 2 + 1", "(+ (// 7 2) 1)"},
+		{"1 + 2 < 3 * 4", "(< (+ 1 2) (* 3 4))"},
+		{"a < b == c > d", "(== (< a b) (> c d))"},
+		{"a || b && c", "(|| a (&& b c))"},
+		{"!a && b", "(&& (! a) b)"},
+		{"a ? b : c ? d : e", "(? a b (? c d e))"},
+		{"a || b ? 1 : 2", "(? (|| a b) 1 2)"},
+		{"max(1, 2 * 3, sqrt(16))", "(max 1 (* 2 3) (sqrt 16))"},
+		{"log(x, 2) ^ 2", "(^ (log x 2) 2)"},
+	}
+	for _, test := range tests {
+		node, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.expr, err)
+			continue
+		}
+		if got := tree(node); got != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		msg    string
+		token  string
+		column int
+	}{
+		{"", "empty expression", "", 1},
+		{"1 +", "unexpected end of expression", "", 4},
+		{"1 + * 2", "unexpected operator", "*", 5},
+		{"(1 + 2", "mismatched brackets: missing ')'", "(", 1},
+		{"1 + 2)", "mismatched brackets: unexpected ')'", ")", 6},
+		{"2 3", "unexpected number", "3", 3},
+		{"1 # 2", "unexpected character", "#", 3},
+		{"sqrt 4", "missing '(' after function", "sqrt", 1},
+		{"1, 2", "unexpected ',' outside of function call", ",", 2},
+		{"max(1, )", "unexpected ')'", ")", 8},
+		{"sqrt(1, 2)", "wrong number of arguments (2) for function", "sqrt", 1},
+		{"a ? 1", "missing ':' after", "?", 3},
+		{"1 : 2", "unexpected ':'", ":", 3},
+		{"1.", "invalid number", "1.", 1},
+		{"2 * 1__0", "invalid number", "1__0", 5},
+		{"_1 + 2", "invalid number", "_1", 1},
+		{"x + 12abc", "invalid number", "12abc", 5},
+		{"0x", "invalid number", "0x", 1},
+		{"(0x_1)", "invalid number", "0x_1", 2},
+		{"1e + 1", "invalid number", "1e", 1},
+		{"1 - 1e400", "number out of range", "1e400", 5},
+		{"1e-400", "number out of range", "1e-400", 1},
+	}
+	for _, test := range tests {
+		_, err := ParseScript(test.expr)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("ParseScript(%q): error %v, want SyntaxError", test.expr, err)
+			continue
+		}
+		want := SyntaxError{Msg: test.msg, Token: test.token, Column: test.column}
+		if *syntaxErr != want {
+			t.Errorf("ParseScript(%q): error %+v, want %+v", test.expr, *syntaxErr, want)
+		}
+	}
+}
+
+func TestFormatScript(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"((1+2))*3", "(1 + 2) * 3"},
+		{"1-(2-3)", "1 - (2 - 3)"},
+		{"(1-2)-3", "1 - 2 - 3"},
+		{"(2^3)^2", "(2 ^ 3) ^ 2"},
+		{"2^(3^2)", "2 ^ 3 ^ 2"},
+		{"(-2)^2", "(-2) ^ 2"},
+		{"-(2^2)", "-2 ^ 2"},
+		{"2*(-x)", "2 * -x"},
+		{"1_000 + 0x10 + 1e3", "1000 + 16 + 1000"},
+		{"a=1;b=a*2;b", "a = 1; b = a * 2; b"},
+		{"(a ? b : c) ? d : e", "(a ? b : c) ? d : e"},
+		{"MAX( 1 ,2 )", "MAX(1, 2)"},
+	}
+	for _, test := range tests {
+		script, err := ParseScript(test.expr)
+		if err != nil {
+			t.Errorf("ParseScript(%q): %v", test.expr, err)
+			continue
+		}
+		got := FormatScript(script)
+		if got != test.want {
+			t.Errorf("FormatScript(%q) = %q, want %q", test.expr, got, test.want)
+			continue
+		}
+		// каноническая запись разбирается в то же дерево и больше не меняется
+		again, err := ParseScript(got)
+		if err != nil {
+			t.Errorf("ParseScript(%q): %v", got, err)
+			continue
+		}
+		if FormatScript(again) != got {
+			t.Errorf("FormatScript is not idempotent: %q -> %q", got, FormatScript(again))
+		}
+		for i := range script {
+			if tree(script[i].Expr) != tree(again[i].Expr) {
+				t.Errorf("%q and %q parse differently: %s, %s", test.expr, got, tree(script[i].Expr), tree(again[i].Expr))
+			}
+		}
+	}
+}
+
+// compile разбирает, оптимизирует и компилирует скрипт, как BuildOperations
+func compile(t *testing.T, expr string, vars map[string]float64, opts Options) Plan {
+	t.Helper()
+	script, err := ParseScript(expr)
+	if err != nil {
+		t.Fatalf("ParseScript(%q): %v", expr, err)
+	}
+	script, _ = OptimizeScript(script, opts)
+	plan, err := Compile(script, vars, nil)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", expr, err)
+	}
+	return plan
+}
+
+// run выполняет план так же, как вычислители, и возвращает результат
+func run(t *testing.T, plan Plan) float64 {
+	t.Helper()
+	res := make([]float64, len(plan.Operations))
+	value := func(arg PlannedArg) float64 {
+		if arg.IsLiteral() {
+			return arg.Value
+		}
+		return res[arg.From]
+	}
+	for i, o := range plan.Operations {
+		args := make([]float64, len(o.Args))
+		for j, arg := range o.Args {
+			args[j] = value(arg)
+		}
+		if o.Body != "" {
+			res[i] = runRange(t, o, args)
+			continue
+		}
+		op, ok := calc.Operations[o.Oper]
+		if !ok {
+			t.Fatalf("operation %d: unknown operation %q", i, o.Oper)
+		}
+		res[i] = op.Calc(args)
+	}
+	return value(plan.Result)
+}
+
+// runRange считает часть свёртки по диапазону, как вычислитель
+func runRange(t *testing.T, o PlannedOperation, args []float64) float64 {
+	t.Helper()
+	body, err := Parse(o.Body)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", o.Body, err)
+	}
+	env := map[string]float64{}
+	for i, name := range o.Params[1:] {
+		env[name] = args[i+2]
+	}
+	res, err := EvaluateRange(o.Oper, o.Params[0], args[0], args[1], body, env)
+	if err != nil {
+		t.Fatalf("%s(%s): %v", o.Oper, o.Body, err)
+	}
+	return res
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		expr  string
+		want  float64
+		opers int
+		depth int
+	}{
+		{"(5)", 5, 0, 0},
+		{"-5", -5, 0, 0},
+		{"2 + 2 * 2", 6, 2, 2},
+		{"2 ^ 3 ^ 2", 512, 2, 2},
+		{"-(1 + 2)", -3, 2, 2},
+		{"1 + 2 + 3 + 4", 10, 3, 2},
+		{"max(1, 2 * 3, sqrt(16))", 6, 3, 2},
+		{"log(8, 2)", 3, 1, 1},
+		{"7 % 3 + 7 // 2", 4, 3, 2},
+	}
+	for _, test := range tests {
+		plan := compile(t, test.expr, nil, DefaultOptions)
+		if got := run(t, plan); got != test.want {
+			t.Errorf("%q = %v, want %v", test.expr, got, test.want)
+		}
+		if len(plan.Operations) != test.opers || plan.Depth() != test.depth {
+			t.Errorf("%q: %d operations of depth %d, want %d of depth %d",
+				test.expr, len(plan.Operations), plan.Depth(), test.opers, test.depth)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		expr string
+		opts Options
+		want string
+	}{
+		{"x * 1 + 0", Options{Simplify: true}, "x"},
+		{"1 * x / 1", Options{Simplify: true}, "x"},
+		{"x ^ 1 - 0", Options{Simplify: true}, "x"},
+		{"2 * 3 + x", Options{FoldConstants: true}, "6 + x"},
+		// бесконечность и NaN не записать числом, они остаются выражением
+		{"1 / 0 + x", Options{FoldConstants: true}, "1 / 0 + x"},
+		{"sum(i, 1, 3, i + 0 / 0)", Options{FoldConstants: true}, "sum(i, 1, 3, i + 0 / 0)"},
+		{"-(2 ^ 2000)", Options{FoldConstants: true}, "-2 ^ 2000"},
+		{"a + b + c + d", Options{Rebalance: true}, "a + b + (c + d)"},
+		{"a + b + c + d", Options{}, "a + b + c + d"},
+	}
+	for _, test := range tests {
+		script, err := ParseScript(test.expr)
+		if err != nil {
+			t.Fatalf("ParseScript(%q): %v", test.expr, err)
+		}
+		script, _ = OptimizeScript(script, test.opts)
+		if got := FormatScript(script); got != test.want {
+			t.Errorf("OptimizeScript(%q, %+v) = %q, want %q", test.expr, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestOptimizeKeepsColumns(t *testing.T) {
+	script, err := ParseScript("1 + 2 + sqrt(x * 1) + 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ = OptimizeScript(script, Options{Simplify: true, FoldConstants: true, Rebalance: true})
+	var call *Call
+	var find func(Node)
+	find = func(node Node) {
+		switch n := node.(type) {
+		case *Call:
+			call = n
+		case *Binary:
+			find(n.Left)
+			find(n.Right)
+		}
+	}
+	find(script[0].Expr)
+	if call == nil || call.Column != 9 {
+		t.Errorf("sqrt after OptimizeScript: %+v, want column 9", call)
+	}
+}
+
+func TestCommonSubexpressions(t *testing.T) {
+	vars := map[string]float64{"a": 2, "b": 3, "c": 1}
+	tests := []struct {
+		expr  string
+		want  float64
+		opers int
+	}{
+		{"(a * b) + (a * b) / 2", 9, 3},
+		{"x = a * b; x + a * b", 12, 2},
+		{"sqrt(a + b) * sqrt(a + b)", 5.000000000000001, 3},
+		// ветка может быть пропущена, поэтому снаружи a * b считается заново
+		{"(a > c ? a * b : 1) + a * b", 12, 5},
+	}
+	for _, test := range tests {
+		plan := compile(t, test.expr, vars, DefaultOptions)
+		if got := run(t, plan); got != test.want {
+			t.Errorf("%q = %v, want %v", test.expr, got, test.want)
+		}
+		if len(plan.Operations) != test.opers {
+			t.Errorf("%q: %d operations, want %d", test.expr, len(plan.Operations), test.opers)
+		}
+	}
+
+	plan := compile(t, "(a * b) + (a * b) / 2", vars, DefaultOptions)
+	if consumers := plan.Operations[0].Consumers; len(consumers) != 2 {
+		t.Errorf("a * b: consumers %v, want 2", consumers)
+	}
+}
+
+func TestCheckUnbound(t *testing.T) {
+	tests := []struct {
+		expr    string
+		vars    map[string]float64
+		missing []string
+	}{
+		{"rate * 0", nil, []string{"rate"}},
+		{"a * 0 + b * 1", map[string]float64{"b": 1}, []string{"a"}},
+		{"x = 2; x * y", nil, []string{"y"}},
+		{"y = x; x = 1; y", nil, []string{"x"}},
+		{"x = x + 1; x", map[string]float64{"x": 1}, nil},
+		{"sum(i, 1, 3, i * k)", nil, []string{"k"}},
+		{"$1 * 0", nil, nil},
+	}
+	for _, test := range tests {
+		script, err := ParseScript(test.expr)
+		if err != nil {
+			t.Fatalf("ParseScript(%q): %v", test.expr, err)
+		}
+		err = CheckUnbound(script, test.vars)
+		var unbound *UnboundError
+		if test.missing == nil {
+			if err != nil {
+				t.Errorf("CheckUnbound(%q): %v", test.expr, err)
+			}
+			continue
+		}
+		if !errors.As(err, &unbound) || strings.Join(unbound.Missing, ",") != strings.Join(test.missing, ",") {
+			t.Errorf("CheckUnbound(%q) = %v, want missing %v", test.expr, err, test.missing)
+		}
+	}
+}
+
+func TestExactOperands(t *testing.T) {
+	tests := []struct {
+		expr  string
+		exact []string
+	}{
+		{"0.1 + 0.2", []string{"0.1", "0.2"}},
+		{"-0.1 * 3", []string{"-0.1", "3"}},
+		{"1e-3 + x", []string{"0.001", "0.5"}},
+		{"0x10 / 3", []string{"16", "3"}},
+	}
+	// в точном режиме числа не сворачиваются, вычислители получают их точную запись
+	opts := Options{Exact: true, FoldConstants: true}
+	for _, test := range tests {
+		plan := compile(t, test.expr, map[string]float64{"x": 0.5}, opts)
+		if len(plan.Operations) != 1 {
+			t.Errorf("%q: %d operations, want 1", test.expr, len(plan.Operations))
+			continue
+		}
+		var exact []string
+		for _, arg := range plan.Operations[0].Args {
+			exact = append(exact, arg.Exact)
+		}
+		if strings.Join(exact, " ") != strings.Join(test.exact, " ") {
+			t.Errorf("%q: exact args %q, want %q", test.expr, exact, test.exact)
+		}
+	}
+}
+
+func TestExpandFunctions(t *testing.T) {
+	funcs := map[string]UserFunction{}
+	for _, definition := range []string{
+		"f(x) = sum(i, 1, 3, x)",
+		"g(x, y) = sum(i, 1, 2, sum(i_1, 1, 2, x * i + y))",
+		"h(i) = sum(i, 1, 3, i)",
+	} {
+		f, err := ParseFunction(definition)
+		if err != nil {
+			t.Fatalf("ParseFunction(%q): %v", definition, err)
+		}
+		funcs[f.Name] = f
+	}
+	tests := []struct {
+		script   string
+		expanded string
+		value    float64
+	}{
+		// индекс свёртки не захватывает переменную из аргумента
+		{"i = 5; f(i)", "i = 5; sum(i_1, 1, 3, i)", 15},
+		{"i = 5; f(i * 2)", "i = 5; sum(i_1, 1, 3, i * 2)", 30},
+		{"i = 5; f(1)", "i = 5; sum(i, 1, 3, 1)", 3},
+		// новое имя не совпадает с индексами внутри тела
+		{"i = 1; g(i, i)", "i = 1; sum(i_2, 1, 2, sum(i_1, 1, 2, i * i_2 + i))", 10},
+		{"i = 5; h(i)", "i = 5; sum(i, 1, 3, i)", 6},
+	}
+	for _, test := range tests {
+		script, err := ParseScript(test.script)
+		if err != nil {
+			t.Fatalf("ParseScript(%q): %v", test.script, err)
+		}
+		script, err = ExpandFunctions(script, funcs)
+		if err != nil {
+			t.Errorf("ExpandFunctions(%q): %v", test.script, err)
+			continue
+		}
+		if got := FormatScript(script); got != test.expanded {
+			t.Errorf("ExpandFunctions(%q) = %q, want %q", test.script, got, test.expanded)
+		}
+		env := map[string]float64{}
+		var value float64
+		for _, statement := range script {
+			value, err = Evaluate(statement.Expr, env)
+			if err != nil {
+				t.Fatalf("Evaluate(%q): %v", test.script, err)
+			}
+			if statement.Name != "" {
+				env[statement.Name] = value
+			}
+		}
+		if value != test.value {
+			t.Errorf("%q = %v, want %v", test.script, value, test.value)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		expr  string
+		want  float64
+		opers int
+	}{
+		{"sum(i, 1, 100, i)", 5050, 1},
+		{"product(i, 1, 5, i)", 120, 1},
+		{"sum(i, 5, 1, i)", 0, 0},
+		{"x = 2; sum(i, 1, 3, i * x)", 12, 1},
+		{"sum(i, -3, 3, i * i)", 28, 1},
+		{"sum(i, 1, 25000, 1)", 25000, 5},
+		// границы из чисел считаются сразу и без fold_constants
+		{"sum(i, 1, 2 * 5, i)", 55, 1},
+		{"n = 2 * 5; sum(i, 1, n, i)", 55, 2},
+		{"n = 2 * 5; sum(i, n - 9, n > 5 ? n : 0, i)", 55, 2},
+	}
+	for _, test := range tests {
+		plan := compile(t, test.expr, nil, DefaultOptions)
+		if got := run(t, plan); got != test.want {
+			t.Errorf("%q = %v, want %v", test.expr, got, test.want)
+		}
+		if len(plan.Operations) != test.opers {
+			t.Errorf("%q: %d operations, want %d", test.expr, len(plan.Operations), test.opers)
+		}
+	}
+
+	// длинный диапазон делится не больше чем на maxRangeParts частей
+	plan := compile(t, "sum(i, 1, 1e9, i)", nil, DefaultOptions)
+	parts := 0
+	var last float64
+	for _, o := range plan.Operations {
+		if o.Oper == "sum_range" {
+			parts++
+			last = max(last, o.Args[1].Value)
+		}
+	}
+	if parts != maxRangeParts || last != 1e9 {
+		t.Errorf("sum(i, 1, 1e9, i): %d parts up to %v, want %d up to 1e9", parts, last, maxRangeParts)
+	}
+
+	errs := []struct {
+		expr   string
+		msg    string
+		column int
+	}{
+		{"sum(i, 1, 1e16, i)", "range bounds must not exceed 2^53 in absolute value", 1},
+		{"x = 1; sum(i, 1, 2 ^ 52, i)", "range must not have more than 1000000000 values", 8},
+		{"product(i, 0, 1e9, i)", "range must not have more than 1000000000 values", 1},
+		{"sum(i, -1e16, 1, i)", "range bounds must not exceed 2^53 in absolute value", 1},
+		{"product(i, 1e300, 1e301, i)", "range bounds must not exceed 2^53 in absolute value", 1},
+		{"product(i, 1, 1 / 0, i)", "range bounds must not exceed 2^53 in absolute value", 1},
+		{"sum(i, 1, sqrt(2), i)", "range bounds must be integers", 1},
+		{"sum(i, 1, sum([1, 2]), i)", "range bounds must be known in advance", 1},
+		{"sum(i, 1, sum(j, 1, 2, j), i)", "range bounds must be known in advance", 1},
+	}
+	for _, test := range errs {
+		script, err := ParseScript(test.expr)
+		if err != nil {
+			t.Fatalf("ParseScript(%q): %v", test.expr, err)
+		}
+		var planErr *PlanError
+		_, err = Compile(script, nil, nil)
+		if !errors.As(err, &planErr) || planErr.Msg != test.msg || planErr.Column != test.column {
+			t.Errorf("Compile(%q) = %v, want %q at column %d", test.expr, err, test.msg, test.column)
+		}
+	}
+	if _, err := EvaluateRange("sum_range", "i", 1, 1e16, &Variable{Name: "i"}, map[string]float64{}); err == nil {
+		t.Errorf("EvaluateRange up to 1e16: no error")
+	}
+
+	// вложенные свёртки вместе перебирают не больше RangeMax значений
+	defer func(limit int64) { RangeMax = limit }(RangeMax)
+	RangeMax = 100
+	body, _ := Parse("sum(j, 1, 10, j)")
+	if res, err := EvaluateRange("sum_range", "i", 1, 9, body, map[string]float64{}); err != nil || res != 495 {
+		t.Errorf("EvaluateRange over 99 values = %v, %v; want 495", res, err)
+	}
+	if _, err := EvaluateRange("sum_range", "i", 1, 10, body, map[string]float64{}); err == nil {
+		t.Errorf("EvaluateRange over 110 values: no error")
+	}
+}
+
+func TestMatchCanonical(t *testing.T) {
+	tests := []struct {
+		canonical string
+		q         string
+		want      bool
+	}{
+		{"1 + 2 * 3", "2 * 3", true},
+		{"12 * 34", "2 * 3", false},
+		{"sqrt(x) + 1", "sqrt(x)", true},
+		{"sqrt(xy) + 1", "sqrt(x", false},
+		{"x = 2; x * 3", "x * 3", true},
+		{"1 + 2", "", true},
+		{"1 + 2", "1 #", false},
+		{"a # b", "a #", true},
+	}
+	for _, test := range tests {
+		if got := MatchCanonical(test.canonical, test.q); got != test.want {
+			t.Errorf("MatchCanonical(%q, %q) = %v, want %v", test.canonical, test.q, got, test.want)
+		}
+	}
+}
+
+func TestListChunks(t *testing.T) {
+	defer func(chunk int) { ListChunk = chunk }(ListChunk)
+	ListChunk = 2
+
+	// части списка передаются следующей поэлементной операции напрямую,
+	// concat нужен только для значения имени и результата
+	plan := compile(t, "v = [1, 2, 3, 4, 5] * y; w = v + v; sum(w * 2)", map[string]float64{"y": 3}, Options{})
+	concats := 0
+	for i, o := range plan.Operations {
+		if o.Oper == "concat" {
+			concats++
+			continue
+		}
+		for _, arg := range o.Args {
+			if o.End > 0 && arg.Len > o.End-o.Start {
+				t.Errorf("operation %d %s[%d:%d] gets a list of %d", i, o.Oper, o.Start, o.End, arg.Len)
+			}
+		}
+	}
+	// v и w - значения имён
+	if concats != 2 {
+		t.Errorf("%d concat operations, want 2", concats)
+	}
+}
+
+// runLists выполняет план со списками так же, как вычислители
+func runLists(t *testing.T, plan Plan) calc.Value {
+	t.Helper()
+	res := make([]calc.Value, len(plan.Operations))
+	value := func(arg PlannedArg) calc.Value {
+		if arg.IsLiteral() {
+			return calc.Value{Number: arg.Value, List: arg.List}
+		}
+		return res[arg.From]
+	}
+	for i, o := range plan.Operations {
+		args := make([]calc.Value, len(o.Args))
+		withLists := false
+		for j, arg := range o.Args {
+			args[j] = value(arg)
+			if o.End > 0 && len(args[j].List) > o.End-o.Start {
+				args[j].List = args[j].List[o.Start:o.End]
+			}
+			withLists = withLists || args[j].List != nil
+		}
+		var err error
+		if op, ok := calc.ListOperations[o.Oper]; ok {
+			res[i], err = op.Calc(args)
+		} else if op, ok := calc.Operations[o.Oper]; ok && withLists {
+			res[i], err = calc.Elementwise(op, args)
+		} else if ok {
+			numbers := make([]float64, len(args))
+			for j, arg := range args {
+				numbers[j] = arg.Number
+			}
+			res[i].Number = op.Calc(numbers)
+		} else {
+			t.Fatalf("operation %d: unknown operation %q", i, o.Oper)
+		}
+		if err != nil {
+			t.Fatalf("operation %d %s: %v", i, o.Oper, err)
+		}
+	}
+	return value(plan.Result)
+}
+
+func TestLists(t *testing.T) {
+	defer func(chunk int) { ListChunk = chunk }(ListChunk)
+	ListChunk = 2
+
+	tests := []struct {
+		expr string
+		want calc.Value
+		// сколько операций каждого вида в плане
+		opers map[string]int
+	}{
+		// готовый список не требует операций
+		{"[1, x, 3]", calc.Value{List: []float64{1, 2, 3}}, map[string]int{}},
+		{"[1, 2]", calc.Value{List: []float64{1, 2}}, map[string]int{}},
+		// поэлементная операция по частям и склейка результата
+		{"[1, 2, 3, 4, 5] * x", calc.Value{List: []float64{2, 4, 6, 8, 10}}, map[string]int{"*": 3, "concat": 1}},
+		{"[1, 2, 3] + [4, 5, 6] * x", calc.Value{List: []float64{9, 12, 15}}, map[string]int{"*": 2, "+": 2, "concat": 1}},
+		{"-[1, 2, 3] % 2", calc.Value{List: []float64{1, 0, 1}}, map[string]int{"%": 2, "concat": 1}},
+		// свёртки: части и дерево из + или *
+		{"sum([1, 2, 3, 4, 5])", calc.Value{Number: 15}, map[string]int{"sum": 3, "+": 2}},
+		{"product([1, 2, 3, 4, 5])", calc.Value{Number: 120}, map[string]int{"product": 3, "*": 2}},
+		{"avg([1, 2, 3, 4, 5] * x)", calc.Value{Number: 6}, map[string]int{"*": 3, "sum": 3, "+": 2, "/": 1}},
+		{"dot([1, 2, 3], [4, 5, 6] * x)", calc.Value{Number: 64}, map[string]int{"*": 2, "dot": 2, "+": 1}},
+		{"sum([1, 2])", calc.Value{Number: 3}, map[string]int{"sum": 1}},
+		// значение имени склеивается, следующие операции берут части
+		{"v = [1, 2, 3] * x; sum(v) + dot(v, v)", calc.Value{Number: 68}, nil},
+	}
+	for _, test := range tests {
+		plan := compile(t, test.expr, map[string]float64{"x": 2}, Options{})
+		got := runLists(t, plan)
+		if got.Number != test.want.Number || !slices.Equal(got.List, test.want.List) {
+			t.Errorf("%q = %v, want %v", test.expr, got, test.want)
+		}
+		if test.opers == nil {
+			continue
+		}
+		opers := map[string]int{}
+		for _, o := range plan.Operations {
+			opers[o.Oper]++
+		}
+		if !reflect.DeepEqual(opers, test.opers) {
+			t.Errorf("%q: operations %v, want %v", test.expr, opers, test.opers)
+		}
+	}
+}
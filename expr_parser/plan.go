@@ -0,0 +1,653 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+)
+
+// noOperation в PlannedArg.From - значение аргумента уже известно
+const noOperation = -1
+
+// ListChunk - сколько элементов списка считает одна операция. Поэлементные
+// операции и свёртки более длинных списков делятся на части, которые разные
+// вычислители считают параллельно.
+var ListChunk = 1000
+
+type (
+	// PlannedArg - аргумент операции: либо готовое число (или список),
+	// либо результат операции с индексом From.
+	PlannedArg struct {
+		Value float64
+		// точное значение числа, пустое - если его нет
+		Exact string
+		From  int
+		// id операции другого выражения, результат которой станет аргументом
+		External int64
+		// готовый список вместо числа Value
+		List []float64
+		// длина списка, который придёт в аргумент; 0 - придёт число
+		Len int
+	}
+	// PlannedLink - куда передать результат: номер операции и её аргумента
+	PlannedLink struct {
+		Operation int
+		Arg       int
+	}
+	// PlannedGuard - операция зависит от того, какую ветку выбрало условие
+	// Operation. Arg == -1: операция стоит в ветке Then и без неё не нужна.
+	// Arg >= 0: аргумент Arg операции выбора приходит из ветки Then.
+	PlannedGuard struct {
+		Operation int
+		Then      bool
+		Arg       int
+	}
+	PlannedOperation struct {
+		Oper      string
+		Args      []PlannedArg
+		Consumers []PlannedLink
+		Guards    []PlannedGuard
+		// длина списка-результата, 0 - результат число
+		Len int
+		// End > 0 - операция считает только элементы [Start, End) списков
+		Start int
+		End   int
+		// у свёртки по диапазону: тело и имена значений в нём - индекс,
+		// затем значения аргументов после границ
+		Body   string
+		Params []string
+	}
+	// PlannedName - имя, которому в скрипте присвоено значение
+	PlannedName struct {
+		Name string
+		Arg  PlannedArg
+	}
+	// Plan - граф операций выражения до записи в базу.
+	// Операции идут в таком порядке, что аргументы вычисляются раньше.
+	Plan struct {
+		Operations []PlannedOperation
+		Result     PlannedArg
+		// имена в порядке первого присваивания, с последним присвоенным значением
+		Names []PlannedName
+		// уже запланированные операции, ключ - ветки, в которых они стоят,
+		// операция и её аргументы
+		known map[string]PlannedArg
+		// ветки условий, внутри которых сейчас идёт компиляция
+		guards []PlannedGuard
+		// текущие значения присвоенных имён
+		scope map[string]PlannedArg
+		vars  map[string]float64
+		refs  map[int64]PlannedArg
+		// переменные, для которых не передали значения
+		unbound map[string]bool
+		// первая ошибка в типах: список там, где нужно число, и наоборот
+		err error
+	}
+	// UnboundError - в выражении есть переменные без значений.
+	UnboundError struct {
+		Msg     string   `json:"error"`
+		Missing []string `json:"missing"`
+	}
+)
+
+func (e *UnboundError) Error() string {
+	return e.Msg + ": " + strings.Join(e.Missing, ", ")
+}
+
+// PlanError - выражение нельзя разбить на операции: список стоит там, где он
+// не подходит, у списков разная длина или у свёртки по диапазону неизвестны границы.
+// Expr - подвыражение с ошибкой, Column - где стоит его функция, если известно.
+type PlanError struct {
+	Msg    string `json:"error"`
+	Expr   string `json:"expr"`
+	Column int    `json:"column,omitempty"`
+}
+
+func (e *PlanError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%s: %s at column %d", e.Msg, e.Expr, e.Column)
+	}
+	return e.Msg + ": " + e.Expr
+}
+
+func literalArg(value float64) PlannedArg {
+	return exactArg(value, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func exactArg(value float64, exact string) PlannedArg {
+	return PlannedArg{Value: value, Exact: exact, From: noOperation}
+}
+
+// listArg - готовый список; в точном режиме у списков точных значений нет
+func listArg(list []float64) PlannedArg {
+	return PlannedArg{List: list, Len: len(list), From: noOperation}
+}
+
+func (a PlannedArg) IsLiteral() bool {
+	return a.From == noOperation && a.External == 0
+}
+
+func (a PlannedArg) IsExternal() bool {
+	return a.External != 0
+}
+
+// Compile превращает инструкции скрипта в один граф операций.
+// Переменная берёт значение, присвоенное ей в одной из предыдущих
+// инструкций, а если такого нет - из vars. Ссылки на другие выражения
+// должны быть заранее найдены в refs, см. ResolveReferences.
+// Одинаковые операции над одинаковыми аргументами вычисляются один раз,
+// их результат передаётся всем операциям, которым он нужен.
+func Compile(script []Statement, vars map[string]float64, refs map[int64]PlannedArg) (Plan, error) {
+	plan := Plan{
+		known:   map[string]PlannedArg{},
+		scope:   map[string]PlannedArg{},
+		vars:    vars,
+		refs:    refs,
+		unbound: map[string]bool{},
+	}
+	for _, statement := range script {
+		plan.Result = plan.add(statement.Expr)
+		if statement.Name != "" {
+			plan.assign(statement.Name, plan.Result)
+		}
+	}
+	if plan.Result.IsExternal() {
+		// результат выражения должна дать его собственная операция
+		plan.Result = plan.plan(PlannedOperation{Oper: "ref", Args: []PlannedArg{plan.Result}, Len: plan.Result.Len})
+	}
+	if plan.err != nil {
+		return plan, plan.err
+	}
+	plan.prune()
+	if len(plan.unbound) > 0 {
+		missing := make([]string, 0, len(plan.unbound))
+		for name := range plan.unbound {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return plan, &UnboundError{Msg: "unbound variables", Missing: missing}
+	}
+	return plan, nil
+}
+
+// CheckUnbound проверяет, что у каждой переменной скрипта есть значение:
+// её имени присвоено раньше или она есть в vars. Проверять нужно до
+// OptimizeScript - упрощение x * 0 убирает переменную из выражения.
+func CheckUnbound(script []Statement, vars map[string]float64) error {
+	assigned := map[string]bool{}
+	var missing []string
+	for _, statement := range script {
+		for _, value := range freeValues(statement.Expr, assigned, nil) {
+			name := value.String()
+			if _, ok := vars[name]; ok {
+				continue
+			}
+			if v, ok := value.(*Variable); ok && !slices.Contains(missing, v.Name) {
+				missing = append(missing, v.Name)
+			}
+		}
+		if statement.Name != "" {
+			assigned[statement.Name] = true
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &UnboundError{Msg: "unbound variables", Missing: missing}
+	}
+	return nil
+}
+
+func (p *Plan) assign(name string, arg PlannedArg) {
+	p.scope[name] = arg
+	for i := range p.Names {
+		if p.Names[i].Name == name {
+			p.Names[i].Arg = arg
+			return
+		}
+	}
+	p.Names = append(p.Names, PlannedName{Name: name, Arg: arg})
+}
+
+func (p *Plan) add(node Node) PlannedArg {
+	switch n := node.(type) {
+	case *Literal:
+		return exactArg(n.Value, n.exact())
+	case *Variable:
+		if arg, ok := p.scope[n.Name]; ok {
+			return arg
+		}
+		value, ok := p.vars[n.Name]
+		if !ok {
+			p.unbound[n.Name] = true
+		}
+		return literalArg(value)
+	case *Reference:
+		arg, ok := p.refs[n.ExprId]
+		if !ok {
+			panic("unresolved reference")
+		}
+		return arg
+	case *Unary:
+		x := p.add(n.X)
+		if n.Op == "+" {
+			return x
+		}
+		if n.Op == "!" {
+			return p.apply(n, "not", x)
+		}
+		if x.IsLiteral() && x.List != nil {
+			list := make([]float64, len(x.List))
+			for i, value := range x.List {
+				list[i] = -value
+			}
+			return listArg(list)
+		}
+		if x.IsLiteral() {
+			// знаковый литерал, например -5
+			return exactArg(-x.Value, negateExact(x.Exact))
+		}
+		return p.apply(n, "neg", x)
+	case *Binary:
+		return p.apply(n, n.Op, p.add(n.Left), p.add(n.Right))
+	case *Call:
+		if isRange(n) {
+			return p.series(n)
+		}
+		args := make([]PlannedArg, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = p.add(arg)
+		}
+		if listFunctions[n.Name] {
+			return p.listFunction(n, args)
+		}
+		return p.apply(n, n.Name, args...)
+	case *Conditional:
+		return p.conditional(n)
+	case *List:
+		return p.list(n)
+	}
+	panic("unknown node")
+}
+
+// fail запоминает первую ошибку в типах; компиляция продолжается,
+// вместо неправильного значения подставляется 0
+func (p *Plan) fail(msg string, node Node) PlannedArg {
+	if p.err == nil {
+		err := &PlanError{Msg: msg, Expr: node.String()}
+		if call, ok := node.(*Call); ok {
+			err.Column = call.Column
+		}
+		p.err = err
+	}
+	return literalArg(0)
+}
+
+// операции, которые над списками выполняются поэлементно
+func elementwise(oper string) bool {
+	switch oper {
+	case "min", "max", "if":
+		return false
+	}
+	_, ok := calc.Operations[oper]
+	return ok
+}
+
+// apply планирует операцию oper. Если среди аргументов есть списки,
+// они должны быть одной длины, а операция выполняется поэлементно.
+func (p *Plan) apply(node Node, oper string, args ...PlannedArg) PlannedArg {
+	n := 0
+	for _, arg := range args {
+		if arg.Len == 0 {
+			continue
+		}
+		if n != 0 && arg.Len != n {
+			return p.fail("list lengths differ", node)
+		}
+		n = arg.Len
+	}
+	if n == 0 {
+		return p.operation(oper, args...)
+	}
+	if !elementwise(oper) {
+		return p.fail("operation is not defined for lists", node)
+	}
+	if n <= ListChunk {
+		return p.plan(PlannedOperation{Oper: oper, Args: args, Len: n})
+	}
+	var parts []PlannedArg
+	for start := 0; start < n; start += ListChunk {
+		end := min(start+ListChunk, n)
+		parts = append(parts, p.plan(PlannedOperation{
+			Oper:  oper,
+			Args:  p.sliceArgs(args, start, end),
+			Len:   end - start,
+			Start: start,
+			End:   end,
+		}))
+	}
+	return p.plan(PlannedOperation{Oper: "concat", Args: parts, Len: n})
+}
+
+// sliceArgs готовит аргументы операции, которая считает часть [start, end)
+// списков: готовые списки обрезаются сразу, у списка, склеенного concat,
+// берётся его часть с теми же границами, остальные обрежет SendTask
+func (p *Plan) sliceArgs(args []PlannedArg, start, end int) []PlannedArg {
+	sliced := make([]PlannedArg, len(args))
+	for i, arg := range args {
+		sliced[i] = arg
+		if arg.List != nil {
+			sliced[i] = listArg(arg.List[start:end])
+		} else if part, ok := p.part(arg, start, end); ok {
+			sliced[i] = part
+		}
+	}
+	return sliced
+}
+
+// part возвращает часть [start, end) списка arg, если его склеивает concat
+// из частей с такими же границами
+func (p *Plan) part(arg PlannedArg, start, end int) (PlannedArg, bool) {
+	if arg.IsLiteral() || arg.IsExternal() || p.Operations[arg.From].Oper != "concat" {
+		return PlannedArg{}, false
+	}
+	offset := 0
+	for _, part := range p.Operations[arg.From].Args {
+		if offset == start && part.Len == end-start {
+			return part, true
+		}
+		offset += part.Len
+	}
+	return PlannedArg{}, false
+}
+
+// prune убирает операции concat, результат которых никому не нужен: части
+// списка ушли следующим операциям напрямую, а сам список не результат
+// и не значение имени. Номера остальных операций сдвигаются.
+func (p *Plan) prune() {
+	used := map[int]bool{}
+	for _, arg := range append([]PlannedArg{p.Result}, p.names()...) {
+		if !arg.IsLiteral() && !arg.IsExternal() {
+			used[arg.From] = true
+		}
+	}
+	index := make([]int, len(p.Operations))
+	var kept []PlannedOperation
+	for i, o := range p.Operations {
+		if o.Oper == "concat" && len(o.Consumers) == 0 && !used[i] {
+			index[i] = noOperation
+			continue
+		}
+		index[i] = len(kept)
+		kept = append(kept, o)
+	}
+	if len(kept) == len(p.Operations) {
+		return
+	}
+	move := func(arg *PlannedArg) {
+		if !arg.IsLiteral() && !arg.IsExternal() {
+			arg.From = index[arg.From]
+		}
+	}
+	for i := range kept {
+		o := &kept[i]
+		o.Args = append([]PlannedArg(nil), o.Args...)
+		for j := range o.Args {
+			move(&o.Args[j])
+		}
+		var consumers []PlannedLink
+		for _, c := range o.Consumers {
+			if index[c.Operation] != noOperation {
+				consumers = append(consumers, PlannedLink{Operation: index[c.Operation], Arg: c.Arg})
+			}
+		}
+		o.Consumers = consumers
+		o.Guards = append([]PlannedGuard(nil), o.Guards...)
+		for j := range o.Guards {
+			o.Guards[j].Operation = index[o.Guards[j].Operation]
+		}
+	}
+	move(&p.Result)
+	for i := range p.Names {
+		move(&p.Names[i].Arg)
+	}
+	p.Operations = kept
+}
+
+func (p *Plan) names() []PlannedArg {
+	args := make([]PlannedArg, len(p.Names))
+	for i, name := range p.Names {
+		args[i] = name.Arg
+	}
+	return args
+}
+
+// функции, которые принимают списки целиком и возвращают число
+var listFunctions = map[string]bool{
+	"sum":     true,
+	"product": true,
+	"avg":     true,
+	"dot":     true,
+	"len":     true,
+}
+
+func (p *Plan) listFunction(n *Call, args []PlannedArg) PlannedArg {
+	for _, arg := range args {
+		if arg.Len == 0 {
+			return p.fail("expected a list", n)
+		}
+	}
+	size := args[0].Len
+	switch n.Name {
+	case "len":
+		return literalArg(float64(size))
+	case "dot":
+		if args[1].Len != size {
+			return p.fail("list lengths differ", n)
+		}
+	case "avg":
+		if size > ListChunk {
+			return p.operation("/", p.reduce("sum", size, args), literalArg(float64(size)))
+		}
+	}
+	return p.reduce(n.Name, size, args)
+}
+
+// reduce планирует свёртку списков длины size: длинные списки делятся на
+// части, части сворачивают разные вычислители, а их результаты
+// собираются сбалансированным деревом операций + (у product - *)
+func (p *Plan) reduce(oper string, size int, args []PlannedArg) PlannedArg {
+	if size <= ListChunk {
+		return p.operation(oper, args...)
+	}
+	var parts []PlannedArg
+	for start := 0; start < size; start += ListChunk {
+		end := min(start+ListChunk, size)
+		parts = append(parts, p.plan(PlannedOperation{
+			Oper:  oper,
+			Args:  p.sliceArgs(args, start, end),
+			Start: start,
+			End:   end,
+		}))
+	}
+	if oper == "product" {
+		return p.tree("*", parts)
+	}
+	return p.tree("+", parts)
+}
+
+func (p *Plan) tree(oper string, parts []PlannedArg) PlannedArg {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	mid := len(parts) / 2
+	return p.operation(oper, p.tree(oper, parts[:mid]), p.tree(oper, parts[mid:]))
+}
+
+// list планирует список: из одних чисел он готов сразу, иначе
+// его собирают операции list, по одной на каждую часть
+func (p *Plan) list(n *List) PlannedArg {
+	elems := make([]PlannedArg, len(n.Elems))
+	literal := true
+	for i, elem := range n.Elems {
+		elems[i] = p.add(elem)
+		if elems[i].Len > 0 {
+			return p.fail("nested lists are not supported", n)
+		}
+		literal = literal && elems[i].IsLiteral()
+	}
+	if literal {
+		values := make([]float64, len(elems))
+		for i, elem := range elems {
+			values[i] = elem.Value
+		}
+		return listArg(values)
+	}
+	if len(elems) <= ListChunk {
+		return p.plan(PlannedOperation{Oper: "list", Args: elems, Len: len(elems)})
+	}
+	var parts []PlannedArg
+	for start := 0; start < len(elems); start += ListChunk {
+		end := min(start+ListChunk, len(elems))
+		parts = append(parts, p.plan(PlannedOperation{Oper: "list", Args: elems[start:end], Len: end - start}))
+	}
+	return p.plan(PlannedOperation{Oper: "concat", Args: parts, Len: len(elems)})
+}
+
+// conditional планирует ветки так, чтобы вычислялась только выбранная:
+// операции веток ждут условие и пропускаются, если их ветка не выбрана.
+func (p *Plan) conditional(n *Conditional) PlannedArg {
+	cond := p.add(n.Cond)
+	if cond.Len > 0 {
+		return p.fail("condition cannot be a list", n)
+	}
+	if cond.IsLiteral() {
+		// условие известно заранее
+		if cond.Value != 0 {
+			return p.add(n.Then)
+		}
+		return p.add(n.Else)
+	}
+	if cond.IsExternal() {
+		// ветки ждут условие так же, как аргумент: нужна своя операция
+		cond = p.operation("ref", cond)
+	}
+
+	p.guards = append(p.guards, PlannedGuard{Operation: cond.From, Then: true, Arg: -1})
+	then := p.add(n.Then)
+	p.guards[len(p.guards)-1].Then = false
+	els := p.add(n.Else)
+	p.guards = p.guards[:len(p.guards)-1]
+
+	if then.Len > 0 || els.Len > 0 {
+		// операция выбора ветки умеет выбирать только числа
+		return p.fail("branches of a condition cannot be lists", n)
+	}
+	if reflect.DeepEqual(then, els) {
+		return then
+	}
+	index := len(p.Operations)
+	res := p.operation("if", cond, then, els)
+	if res.From == index {
+		// значение невыбранной ветки не придёт, его нельзя ждать
+		o := &p.Operations[index]
+		for i, arg := range []PlannedArg{then, els} {
+			if !arg.IsLiteral() && !arg.IsExternal() {
+				o.Guards = append(o.Guards, PlannedGuard{Operation: cond.From, Then: i == 0, Arg: i + 1})
+			}
+		}
+	}
+	return res
+}
+
+func negateExact(exact string) string {
+	x, ok := calc.ParseExact(exact)
+	if !ok {
+		return ""
+	}
+	return calc.FormatExact(x.Neg(x))
+}
+
+// operation планирует операцию над числами
+func (p *Plan) operation(oper string, args ...PlannedArg) PlannedArg {
+	return p.plan(PlannedOperation{Oper: oper, Args: args})
+}
+
+func (p *Plan) plan(o PlannedOperation) PlannedArg {
+	// аргументы уже сведены к числам и номерам операций, поэтому ключ
+	// не зависит от того, как подвыражение записано и через какие имена.
+	// Операцию из ветки можно взять в этой же ветке или во вложенной,
+	// но не снаружи: там она может оказаться пропущенной.
+	call := fmt.Sprint(o.Oper, o.Args, o.Start, o.End, o.Body, o.Params)
+	for i := len(p.guards); i >= 0; i-- {
+		if arg, ok := p.known[fmt.Sprint(p.guards[:i])+call]; ok {
+			return arg
+		}
+	}
+	key := fmt.Sprint(p.guards) + call
+	index := len(p.Operations)
+	for i, arg := range o.Args {
+		if !arg.IsLiteral() && !arg.IsExternal() {
+			consumers := &p.Operations[arg.From].Consumers
+			*consumers = append(*consumers, PlannedLink{Operation: index, Arg: i})
+		}
+	}
+	o.Guards = append([]PlannedGuard(nil), p.guards...)
+	p.Operations = append(p.Operations, o)
+	p.known[key] = PlannedArg{From: index, Len: o.Len}
+	return p.known[key]
+}
+
+// Ready - все аргументы операции известны и она не стоит в ветке условия,
+// её можно сразу отправлять вычислителю.
+func (o PlannedOperation) Ready() bool {
+	for _, arg := range o.Args {
+		if !arg.IsLiteral() {
+			return false
+		}
+	}
+	return len(o.BranchGuards()) == 0
+}
+
+// BranchGuards - условия, от которых зависит, нужна ли операция вообще.
+func (o PlannedOperation) BranchGuards() []PlannedGuard {
+	var guards []PlannedGuard
+	for _, g := range o.Guards {
+		if g.Arg == -1 {
+			guards = append(guards, g)
+		}
+	}
+	return guards
+}
+
+// Depths возвращает для каждой операции длину самой длинной цепочки
+// операций, которая на ней заканчивается. У готовых операций глубина 1.
+func (p Plan) Depths() []int {
+	depths := make([]int, len(p.Operations))
+	for i, o := range p.Operations {
+		depths[i] = 1
+		for _, arg := range o.Args {
+			if arg.From != noOperation && depths[arg.From]+1 > depths[i] {
+				depths[i] = depths[arg.From] + 1
+			}
+		}
+		for _, g := range o.BranchGuards() {
+			depths[i] = max(depths[i], depths[g.Operation]+1)
+		}
+	}
+	return depths
+}
+
+// Depth - длина критического пути: сколько операций выполняется друг за другом
+// даже при неограниченном числе вычислителей.
+func (p Plan) Depth() int {
+	depth := 0
+	for _, d := range p.Depths() {
+		depth = max(depth, d)
+	}
+	return depth
+}
@@ -0,0 +1,416 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Zheleznov-Fedor/new-ya-long-calc/calc"
+)
+
+// RangeChunk - сколько значений индекса перебирает одна операция свёртки
+// по диапазону; частей получается не больше maxRangeParts, у длинных
+// диапазонов части становятся больше.
+var RangeChunk = 10000
+
+const maxRangeParts = 100
+
+// RangeMax - сколько значений индекса может перебрать одна свёртка по
+// диапазону; более длинные диапазоны отклоняются.
+var RangeMax int64 = 1e9
+
+// maxRangeBound - наибольшая по модулю граница диапазона: дальше double
+// различает не все целые, и индекс перестал бы меняться на 1
+const maxRangeBound = 1 << 53
+
+// rangeFunctions - функции, которые с четырьмя аргументами сворачивают
+// выражение по диапазону: sum(i, 1, 100, i * i), и операции вычислителя для них.
+// С одним аргументом это функции от списка.
+var rangeFunctions = map[string]string{
+	"sum":     "sum_range",
+	"product": "product_range",
+}
+
+// isRange - вызов свёртки по диапазону
+func isRange(n *Call) bool {
+	_, ok := rangeFunctions[n.Name]
+	return ok && len(n.Args) == 4
+}
+
+// rangeIndex возвращает индекс свёртки по диапазону
+func rangeIndex(n *Call) (*Variable, bool) {
+	if !isRange(n) {
+		return nil, false
+	}
+	index, ok := n.Args[0].(*Variable)
+	return index, ok
+}
+
+// series планирует свёртку по диапазону: диапазон делится на части, каждую
+// часть вычислитель считает целиком, перебирая индекс сам, а результаты
+// частей сворачиваются деревом операций + или *.
+// Значения, от которых зависит тело, кроме индекса, передаются аргументами.
+func (p *Plan) series(n *Call) PlannedArg {
+	index, ok := n.Args[0].(*Variable)
+	if !ok {
+		return p.fail("expected index variable", n)
+	}
+	from, fromOk := p.constant(n.Args[1])
+	to, toOk := p.constant(n.Args[2])
+	if !fromOk || !toOk {
+		return p.fail("range bounds must be known in advance", n)
+	}
+	if from != math.Trunc(from) || to != math.Trunc(to) {
+		return p.fail("range bounds must be integers", n)
+	}
+	if !inRange(from) || !inRange(to) {
+		return p.fail("range bounds must not exceed 2^53 in absolute value", n)
+	}
+	body := n.Args[3]
+	if hasList(body) {
+		return p.fail("lists are not supported in range functions", n)
+	}
+
+	params := []string{index.Name}
+	var captured []PlannedArg
+	for _, value := range freeValues(body, map[string]bool{index.Name: true}, nil) {
+		arg := p.add(value)
+		if arg.Len > 0 {
+			return p.fail("lists are not supported in range functions", n)
+		}
+		params = append(params, value.String())
+		captured = append(captured, arg)
+	}
+
+	oper := rangeFunctions[n.Name]
+	first, last := int64(from), int64(to)
+	if last < first {
+		return literalArg(calc.RangeOperations[oper].Init)
+	}
+	count := last - first + 1
+	if count > RangeMax {
+		return p.fail(tooLong(), n)
+	}
+	size := max(int64(RangeChunk), (count+maxRangeParts-1)/maxRangeParts)
+	var parts []PlannedArg
+	for start := first; start <= last; start += size {
+		end := min(start+size-1, last)
+		args := append([]PlannedArg{literalArg(float64(start)), literalArg(float64(end))}, captured...)
+		parts = append(parts, p.plan(PlannedOperation{Oper: oper, Args: args, Body: body.String(), Params: params}))
+	}
+	if oper == "product_range" {
+		return p.tree("*", parts)
+	}
+	return p.tree("+", parts)
+}
+
+// constant вычисляет границу диапазона сразу, без операций: число, значение
+// переменной или имени из одних чисел (n = 2 * 5) или выражение над ними.
+// Границы нужны, чтобы разбить диапазон на части, поэтому они считаются
+// и без fold_constants. Вложенные свёртки и списки так не считаются.
+func (p *Plan) constant(node Node) (float64, bool) {
+	if hasList(node) || hasRange(node) {
+		return 0, false
+	}
+	env := map[string]float64{}
+	for _, value := range freeValues(node, nil, nil) {
+		var arg PlannedArg
+		switch v := value.(type) {
+		case *Variable:
+			if _, ok := p.scope[v.Name]; !ok {
+				if _, ok := p.vars[v.Name]; !ok {
+					p.unbound[v.Name] = true
+					return 0, false
+				}
+			}
+			arg = p.add(v)
+		case *Reference:
+			arg = p.add(v)
+		}
+		x, ok := p.constantArg(arg)
+		if !ok {
+			return 0, false
+		}
+		env[value.String()] = x
+	}
+	x, err := Evaluate(node, env)
+	return x, err == nil
+}
+
+// constantArg вычисляет аргумент, если он зависит только от чисел
+func (p *Plan) constantArg(arg PlannedArg) (float64, bool) {
+	if arg.Len > 0 || arg.IsExternal() {
+		return 0, false
+	}
+	if arg.IsLiteral() {
+		return arg.Value, true
+	}
+	o := p.Operations[arg.From]
+	op, ok := calc.Operations[o.Oper]
+	if !ok || o.Len > 0 || o.Body != "" {
+		return 0, false
+	}
+	args := make([]float64, len(o.Args))
+	for i, a := range o.Args {
+		if args[i], ok = p.constantArg(a); !ok {
+			return 0, false
+		}
+	}
+	return op.Calc(args), true
+}
+
+func hasRange(node Node) bool {
+	switch n := node.(type) {
+	case *Unary:
+		return hasRange(n.X)
+	case *Binary:
+		return hasRange(n.Left) || hasRange(n.Right)
+	case *Conditional:
+		return hasRange(n.Cond) || hasRange(n.Then) || hasRange(n.Else)
+	case *Call:
+		if isRange(n) {
+			return true
+		}
+		for _, arg := range n.Args {
+			if hasRange(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inRange - граница диапазона не больше maxRangeBound по модулю (и не NaN)
+func inRange(bound float64) bool {
+	return math.Abs(bound) <= maxRangeBound
+}
+
+func tooLong() string {
+	return fmt.Sprintf("range must not have more than %d values", RangeMax)
+}
+
+// freeValues возвращает переменные и ссылки, от которых зависит выражение,
+// кроме индексов bound, каждую по одному разу
+func freeValues(node Node, bound map[string]bool, found []Node) []Node {
+	switch n := node.(type) {
+	case *Variable, *Reference:
+		if bound[n.String()] {
+			return found
+		}
+		for _, f := range found {
+			if f.String() == n.String() {
+				return found
+			}
+		}
+		return append(found, n)
+	case *Unary:
+		return freeValues(n.X, bound, found)
+	case *Binary:
+		found = freeValues(n.Left, bound, found)
+		return freeValues(n.Right, bound, found)
+	case *Conditional:
+		found = freeValues(n.Cond, bound, found)
+		found = freeValues(n.Then, bound, found)
+		return freeValues(n.Else, bound, found)
+	case *Call:
+		if index, ok := rangeIndex(n); ok {
+			found = freeValues(n.Args[1], bound, found)
+			found = freeValues(n.Args[2], bound, found)
+			inner := map[string]bool{index.Name: true}
+			for name := range bound {
+				inner[name] = true
+			}
+			return freeValues(n.Args[3], inner, found)
+		}
+		for _, arg := range n.Args {
+			found = freeValues(arg, bound, found)
+		}
+	}
+	return found
+}
+
+// Substitute подставляет в выражение значения values вместо переменных
+// и ссылок; индексы свёрток по диапазону не подставляются.
+func Substitute(node Node, values map[string]Node) Node {
+	switch n := node.(type) {
+	case *Variable, *Reference:
+		if value, ok := values[n.String()]; ok {
+			return value
+		}
+	case *Unary:
+		return &Unary{Op: n.Op, X: Substitute(n.X, values)}
+	case *Binary:
+		return &Binary{Op: n.Op, Left: Substitute(n.Left, values), Right: Substitute(n.Right, values)}
+	case *Conditional:
+		return &Conditional{Cond: Substitute(n.Cond, values), Then: Substitute(n.Then, values), Else: Substitute(n.Else, values)}
+	case *List:
+		elems := make([]Node, len(n.Elems))
+		for i, elem := range n.Elems {
+			elems[i] = Substitute(elem, values)
+		}
+		return &List{Elems: elems}
+	case *Call:
+		call := &Call{Name: n.Name, Column: n.Column, Args: make([]Node, len(n.Args))}
+		index, ranged := rangeIndex(n)
+		for i, arg := range n.Args {
+			switch {
+			case ranged && i == 0:
+				call.Args[i] = arg
+			case ranged && i == 3:
+				inner := map[string]Node{}
+				for name, value := range values {
+					if name != index.Name {
+						inner[name] = value
+					}
+				}
+				call.Args[i] = Substitute(arg, inner)
+			default:
+				call.Args[i] = Substitute(arg, values)
+			}
+		}
+		return call
+	}
+	return node
+}
+
+func hasList(node Node) bool {
+	switch n := node.(type) {
+	case *List:
+		return true
+	case *Unary:
+		return hasList(n.X)
+	case *Binary:
+		return hasList(n.Left) || hasList(n.Right)
+	case *Conditional:
+		return hasList(n.Cond) || hasList(n.Then) || hasList(n.Else)
+	case *Call:
+		if listFunctions[n.Name] && !isRange(n) {
+			return true
+		}
+		for _, arg := range n.Args {
+			if hasList(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate вычисляет выражение сразу, без графа операций: так вычислитель
+// считает тело свёртки по диапазону. env - значения переменных и ссылок $N.
+// Вложенные свёртки вместе перебирают не больше RangeMax значений индексов.
+func Evaluate(node Node, env map[string]float64) (float64, error) {
+	return (&evaluator{left: RangeMax}).eval(node, env)
+}
+
+// evaluator помнит, сколько значений индексов ещё можно перебрать
+type evaluator struct {
+	left int64
+}
+
+func (e *evaluator) eval(node Node, env map[string]float64) (float64, error) {
+	switch n := node.(type) {
+	case *Literal:
+		return n.Value, nil
+	case *Variable, *Reference:
+		value, ok := env[n.String()]
+		if !ok {
+			return 0, fmt.Errorf("unknown value %s", n)
+		}
+		return value, nil
+	case *Unary:
+		x, err := e.eval(n.X, env)
+		if err != nil {
+			return 0, err
+		}
+		switch n.Op {
+		case "-":
+			return -x, nil
+		case "!":
+			return calc.Operations["not"].Calc([]float64{x}), nil
+		}
+		return x, nil
+	case *Binary:
+		left, err := e.eval(n.Left, env)
+		if err != nil {
+			return 0, err
+		}
+		right, err := e.eval(n.Right, env)
+		if err != nil {
+			return 0, err
+		}
+		return calc.Operations[n.Op].Calc([]float64{left, right}), nil
+	case *Conditional:
+		cond, err := e.eval(n.Cond, env)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return e.eval(n.Then, env)
+		}
+		return e.eval(n.Else, env)
+	case *Call:
+		args := n.Args
+		if isRange(n) {
+			args = n.Args[1:3]
+		}
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			value, err := e.eval(arg, env)
+			if err != nil {
+				return 0, err
+			}
+			values[i] = value
+		}
+		if isRange(n) {
+			index, ok := n.Args[0].(*Variable)
+			if !ok {
+				return 0, fmt.Errorf("expected index variable in %s", n)
+			}
+			return e.evalRange(rangeFunctions[n.Name], index.Name, values[0], values[1], n.Args[3], env)
+		}
+		op, ok := calc.Operations[n.Name]
+		if !ok || listFunctions[n.Name] {
+			return 0, fmt.Errorf("unknown function %s", n.Name)
+		}
+		return op.Calc(values), nil
+	}
+	return 0, fmt.Errorf("cannot evaluate %s", node)
+}
+
+// EvaluateRange сворачивает body по всем целым index от from до to
+// операцией oper из calc.RangeOperations.
+func EvaluateRange(oper string, index string, from, to float64, body Node, env map[string]float64) (float64, error) {
+	return (&evaluator{left: RangeMax}).evalRange(oper, index, from, to, body, env)
+}
+
+func (e *evaluator) evalRange(oper string, index string, from, to float64, body Node, env map[string]float64) (float64, error) {
+	op, ok := calc.RangeOperations[oper]
+	if !ok {
+		return 0, fmt.Errorf("unknown operation %s", oper)
+	}
+	if !inRange(from) || !inRange(to) {
+		return 0, errors.New("range bounds must not exceed 2^53 in absolute value")
+	}
+	first, last := int64(math.Ceil(from)), int64(math.Floor(to))
+	if count := last - first + 1; count > 0 {
+		if count > e.left {
+			return 0, errors.New(tooLong())
+		}
+		e.left -= count
+	}
+	outer, shadowed := env[index]
+	res := op.Init
+	var err error
+	for i := first; i <= last && err == nil; i++ {
+		env[index] = float64(i)
+		var x float64
+		x, err = e.eval(body, env)
+		res = op.Reduce(res, x)
+	}
+	delete(env, index)
+	if shadowed {
+		env[index] = outer
+	}
+	return res, err
+}
@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"context"
+	sql "database/sql"
+	"errors"
+
+	db "github.com/Zheleznov-Fedor/new-ya-long-calc/db"
+)
+
+// ResolveReferences находит выражения, на которые ссылается скрипт.
+// Результат готового выражения подставляется числом, иначе аргумент будет
+// ждать последнюю операцию этого выражения. Ссылаться можно только
+// на свои выражения, чужие выглядят так же, как несуществующие, и только
+// на те, которые не завершились ошибкой.
+func ResolveReferences(ctx context.Context, d *sql.DB, script []Statement, userId int64) (map[int64]PlannedArg, error) {
+	refs := map[int64]PlannedArg{}
+	var found []*Reference
+	for _, statement := range script {
+		found = references(statement.Expr, found)
+	}
+
+	for _, ref := range found {
+		if _, ok := refs[ref.ExprId]; ok {
+			continue
+		}
+		expr, err := db.SelectExpressionById(ctx, d, ref.ExprId)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && expr.UserId != userId {
+			return nil, &SyntaxError{Msg: "unknown expression", Token: ref.String(), Column: ref.Column}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if expr.State == "failed" {
+			// результата не будет, выражение со ссылкой никогда бы не посчиталось
+			return nil, &SyntaxError{Msg: "referenced expression failed", Token: ref.String(), Column: ref.Column}
+		}
+		if expr.State == "ready" && expr.ResList != nil {
+			refs[ref.ExprId] = listArg(expr.ResList)
+			continue
+		}
+		if expr.State == "ready" {
+			// у выражения, посчитанного не точно, точного значения нет
+			refs[ref.ExprId] = exactArg(expr.Res.Float64, expr.ExactRes.String)
+			continue
+		}
+		final, err := db.SelectFinalOperation(ctx, d, ref.ExprId)
+		if err != nil {
+			return nil, err
+		}
+		refs[ref.ExprId] = PlannedArg{From: noOperation, External: final.Id, Len: int(final.Length)}
+	}
+	return refs, nil
+}
+
+func references(node Node, found []*Reference) []*Reference {
+	switch n := node.(type) {
+	case *Reference:
+		found = append(found, n)
+	case *Unary:
+		found = references(n.X, found)
+	case *Binary:
+		found = references(n.Left, found)
+		found = references(n.Right, found)
+	case *Call:
+		for _, arg := range n.Args {
+			found = references(arg, found)
+		}
+	case *Conditional:
+		found = references(n.Cond, found)
+		found = references(n.Then, found)
+		found = references(n.Else, found)
+	case *List:
+		for _, elem := range n.Elems {
+			found = references(elem, found)
+		}
+	}
+	return found
+}
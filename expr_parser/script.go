@@ -0,0 +1,110 @@
+package parser
+
+import "strings"
+
+// Statement - инструкция скрипта: выражение и имя, которому достаётся
+// его значение. У инструкции без присваивания Name пустой.
+type Statement struct {
+	Name string
+	Expr Node
+}
+
+func (s Statement) String() string {
+	if s.Name == "" {
+		return s.Expr.String()
+	}
+	return s.Name + " = " + s.Expr.String()
+}
+
+// FormatScript записывает скрипт в каноническом виде: пробелы вокруг
+// операторов, только нужные скобки, числа без экспоненты и "_".
+// По-разному записанные одинаковые выражения дают одну и ту же строку.
+func FormatScript(script []Statement) string {
+	statements := make([]string, len(script))
+	for i, statement := range script {
+		statements[i] = statement.String()
+	}
+	return strings.Join(statements, "; ")
+}
+
+// MatchCanonical проверяет, что q встречается в канонической записи canonical
+// целыми токенами: "2 * 3" есть в "1 + 2 * 3", но не в "12 * 34".
+// Запрос, который не разбить на токены, ищется как подстрока.
+func MatchCanonical(canonical, q string) bool {
+	query, err := SplitHumanExpressionToTokens(q)
+	if err != nil {
+		return strings.Contains(canonical, q)
+	}
+	tokens, err := SplitHumanExpressionToTokens(canonical)
+	if err != nil {
+		return false
+	}
+next:
+	for i := 0; i+len(query) <= len(tokens); i++ {
+		for j, token := range query {
+			if tokens[i+j].Text != token.Text {
+				continue next
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ParseScript разбирает скрипт из инструкций, разделённых ";",
+// например "x = 3*4; y = x + 2; y / x". Значение скрипта - значение
+// последней инструкции. Пустые инструкции, например после последней ";", пропускаются.
+func ParseScript(script string) ([]Statement, error) {
+	tokens, err := SplitHumanExpressionToTokens(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []Statement
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && tokens[end].Kind != TokenSemicolon {
+			end++
+		}
+		if end > 0 {
+			statement, err := parseStatement(tokens[:end])
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, statement)
+		}
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+	}
+
+	if len(statements) == 0 {
+		return nil, &SyntaxError{Msg: "empty expression", Column: 1}
+	}
+	return statements, nil
+}
+
+func parseStatement(tokens []Token) (Statement, error) {
+	var statement Statement
+	if len(tokens) > 1 && tokens[0].Kind == TokenIdent && tokens[1].Kind == TokenAssign {
+		if _, ok := functions[tokens[0].Text]; ok {
+			return statement, newSyntaxError("cannot assign to function", tokens[0])
+		}
+		statement.Name = tokens[0].Text
+		if len(tokens) == 2 {
+			return statement, &SyntaxError{
+				Msg:    "unexpected end of expression",
+				Column: tokens[1].Column + 1,
+			}
+		}
+		tokens = tokens[2:]
+	}
+
+	rpn, err := TokensToRPN(tokens)
+	if err != nil {
+		return statement, err
+	}
+	statement.Expr = RPNToAST(rpn)
+	return statement, nil
+}
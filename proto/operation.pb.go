@@ -30,6 +30,10 @@ type OperationRequest struct {
 	A    float32 `protobuf:"fixed32,2,opt,name=a,proto3" json:"a,omitempty"`
 	B    float32 `protobuf:"fixed32,3,opt,name=b,proto3" json:"b,omitempty"`
 	Oper string  `protobuf:"bytes,4,opt,name=oper,proto3" json:"oper,omitempty"`
+	// Аргументы операции по порядку, a и b оставлены для старых вычислителей
+	Args []float32 `protobuf:"fixed32,5,rep,packed,name=args,proto3" json:"args,omitempty"`
+	// Точные значения аргументов строками ("0.1", "1/3"), если выражение считается точно
+	ExactArgs []string `protobuf:"bytes,6,rep,name=exact_args,json=exactArgs,proto3" json:"exact_args,omitempty"`
 }
 
 func (x *OperationRequest) Reset() {
@@ -92,6 +96,20 @@ func (x *OperationRequest) GetOper() string {
 	return ""
 }
 
+func (x *OperationRequest) GetArgs() []float32 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *OperationRequest) GetExactArgs() []string {
+	if x != nil {
+		return x.ExactArgs
+	}
+	return nil
+}
+
 type OperationResult struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -99,6 +117,8 @@ type OperationResult struct {
 
 	Id     int32   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
 	Result float32 `protobuf:"fixed32,2,opt,name=result,proto3" json:"result,omitempty"`
+	// Точный результат, пустой - если точно посчитать не получилось
+	ExactResult string `protobuf:"bytes,3,opt,name=exact_result,json=exactResult,proto3" json:"exact_result,omitempty"`
 }
 
 func (x *OperationResult) Reset() {
@@ -147,29 +167,293 @@ func (x *OperationResult) GetResult() float32 {
 	return 0
 }
 
+func (x *OperationResult) GetExactResult() string {
+	if x != nil {
+		return x.ExactResult
+	}
+	return ""
+}
+
+// Вторая версия: числа передаются в double без потери точности
+type OperationRequestV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id   int32     `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Oper string    `protobuf:"bytes,2,opt,name=oper,proto3" json:"oper,omitempty"`
+	Args []float64 `protobuf:"fixed64,3,rep,packed,name=args,proto3" json:"args,omitempty"`
+	// Точные значения аргументов строками ("0.1", "1/3"), если выражение считается точно
+	ExactArgs []string `protobuf:"bytes,4,rep,name=exact_args,json=exactArgs,proto3" json:"exact_args,omitempty"`
+	// Аргументы-списки: пусто, если списков нет, иначе по одному на каждый
+	// аргумент из args; пустой values - аргумент число из args
+	Lists []*ListArg `protobuf:"bytes,5,rep,name=lists,proto3" json:"lists,omitempty"`
+	// Свёртка по диапазону: выражение, которое вычислитель считает для
+	// каждого значения индекса от args[0] до args[1], и имена в нём -
+	// индекс, затем значения из args после границ
+	Body   string   `protobuf:"bytes,6,opt,name=body,proto3" json:"body,omitempty"`
+	Params []string `protobuf:"bytes,7,rep,name=params,proto3" json:"params,omitempty"`
+}
+
+func (x *OperationRequestV2) Reset() {
+	*x = OperationRequestV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_operation_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *OperationRequestV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationRequestV2) ProtoMessage() {}
+
+func (x *OperationRequestV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_operation_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationRequestV2.ProtoReflect.Descriptor instead.
+func (*OperationRequestV2) Descriptor() ([]byte, []int) {
+	return file_proto_operation_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *OperationRequestV2) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *OperationRequestV2) GetOper() string {
+	if x != nil {
+		return x.Oper
+	}
+	return ""
+}
+
+func (x *OperationRequestV2) GetArgs() []float64 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *OperationRequestV2) GetExactArgs() []string {
+	if x != nil {
+		return x.ExactArgs
+	}
+	return nil
+}
+
+func (x *OperationRequestV2) GetLists() []*ListArg {
+	if x != nil {
+		return x.Lists
+	}
+	return nil
+}
+
+func (x *OperationRequestV2) GetBody() string {
+	if x != nil {
+		return x.Body
+	}
+	return ""
+}
+
+func (x *OperationRequestV2) GetParams() []string {
+	if x != nil {
+		return x.Params
+	}
+	return nil
+}
+
+// Список чисел, пустых списков не бывает
+type ListArg struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Values []float64 `protobuf:"fixed64,1,rep,packed,name=values,proto3" json:"values,omitempty"`
+}
+
+func (x *ListArg) Reset() {
+	*x = ListArg{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_operation_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListArg) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListArg) ProtoMessage() {}
+
+func (x *ListArg) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_operation_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListArg.ProtoReflect.Descriptor instead.
+func (*ListArg) Descriptor() ([]byte, []int) {
+	return file_proto_operation_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListArg) GetValues() []float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type OperationResultV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id     int32   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Result float64 `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	// Точный результат, пустой - если точно посчитать не получилось
+	ExactResult string `protobuf:"bytes,3,opt,name=exact_result,json=exactResult,proto3" json:"exact_result,omitempty"`
+	// Результат-список, тогда result не заполнен
+	ListResult []float64 `protobuf:"fixed64,4,rep,packed,name=list_result,json=listResult,proto3" json:"list_result,omitempty"`
+}
+
+func (x *OperationResultV2) Reset() {
+	*x = OperationResultV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_operation_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *OperationResultV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationResultV2) ProtoMessage() {}
+
+func (x *OperationResultV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_operation_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationResultV2.ProtoReflect.Descriptor instead.
+func (*OperationResultV2) Descriptor() ([]byte, []int) {
+	return file_proto_operation_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *OperationResultV2) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *OperationResultV2) GetResult() float64 {
+	if x != nil {
+		return x.Result
+	}
+	return 0
+}
+
+func (x *OperationResultV2) GetExactResult() string {
+	if x != nil {
+		return x.ExactResult
+	}
+	return ""
+}
+
+func (x *OperationResultV2) GetListResult() []float64 {
+	if x != nil {
+		return x.ListResult
+	}
+	return nil
+}
+
 var File_proto_operation_proto protoreflect.FileDescriptor
 
 var file_proto_operation_proto_rawDesc = []byte{
 	0x0a, 0x15, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f,
 	0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x08, 0x67, 0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72,
-	0x79, 0x22, 0x52, 0x0a, 0x10, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x0c, 0x0a, 0x01, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x02,
-	0x52, 0x01, 0x61, 0x12, 0x0c, 0x0a, 0x01, 0x62, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x01,
-	0x62, 0x12, 0x12, 0x0a, 0x04, 0x6f, 0x70, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x04, 0x6f, 0x70, 0x65, 0x72, 0x22, 0x39, 0x0a, 0x0f, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x02, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x32, 0x51, 0x0a, 0x10, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x72,
-	0x76, 0x69, 0x63, 0x65, 0x12, 0x3d, 0x0a, 0x04, 0x43, 0x61, 0x6c, 0x63, 0x12, 0x1a, 0x2e, 0x67,
-	0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x67, 0x65, 0x6f, 0x6d, 0x65,
-	0x74, 0x72, 0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73,
-	0x75, 0x6c, 0x74, 0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
-	0x6d, 0x2f, 0x5a, 0x68, 0x65, 0x6c, 0x65, 0x7a, 0x6e, 0x6f, 0x76, 0x2d, 0x46, 0x65, 0x64, 0x6f,
-	0x72, 0x2f, 0x6e, 0x65, 0x77, 0x2d, 0x79, 0x61, 0x2d, 0x6c, 0x6f, 0x6e, 0x67, 0x2d, 0x63, 0x61,
-	0x6c, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x79, 0x22, 0x85, 0x01, 0x0a, 0x10, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x0c, 0x0a, 0x01, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x02, 0x52, 0x01, 0x61, 0x12, 0x0c, 0x0a, 0x01, 0x62, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52,
+	0x01, 0x62, 0x12, 0x12, 0x0a, 0x04, 0x6f, 0x70, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x6f, 0x70, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x72, 0x67, 0x73, 0x18, 0x05,
+	0x20, 0x03, 0x28, 0x02, 0x52, 0x04, 0x61, 0x72, 0x67, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x65, 0x78,
+	0x61, 0x63, 0x74, 0x5f, 0x61, 0x72, 0x67, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09,
+	0x65, 0x78, 0x61, 0x63, 0x74, 0x41, 0x72, 0x67, 0x73, 0x22, 0x5c, 0x0a, 0x0f, 0x4f, 0x70, 0x65,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x0e, 0x0a, 0x02,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06,
+	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x02, 0x52, 0x06, 0x72, 0x65,
+	0x73, 0x75, 0x6c, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x65, 0x78, 0x61, 0x63, 0x74, 0x5f, 0x72, 0x65,
+	0x73, 0x75, 0x6c, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x65, 0x78, 0x61, 0x63,
+	0x74, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0xc0, 0x01, 0x0a, 0x12, 0x4f, 0x70, 0x65, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x56, 0x32, 0x12, 0x0e,
+	0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12,
+	0x0a, 0x04, 0x6f, 0x70, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6f, 0x70,
+	0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x72, 0x67, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x01,
+	0x52, 0x04, 0x61, 0x72, 0x67, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x65, 0x78, 0x61, 0x63, 0x74, 0x5f,
+	0x61, 0x72, 0x67, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x65, 0x78, 0x61, 0x63,
+	0x74, 0x41, 0x72, 0x67, 0x73, 0x12, 0x27, 0x0a, 0x05, 0x6c, 0x69, 0x73, 0x74, 0x73, 0x18, 0x05,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x67, 0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e,
+	0x4c, 0x69, 0x73, 0x74, 0x41, 0x72, 0x67, 0x52, 0x05, 0x6c, 0x69, 0x73, 0x74, 0x73, 0x12, 0x12,
+	0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x62, 0x6f,
+	0x64, 0x79, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x61, 0x72, 0x61, 0x6d, 0x73, 0x18, 0x07, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x06, 0x70, 0x61, 0x72, 0x61, 0x6d, 0x73, 0x22, 0x21, 0x0a, 0x07, 0x4c, 0x69,
+	0x73, 0x74, 0x41, 0x72, 0x67, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18,
+	0x01, 0x20, 0x03, 0x28, 0x01, 0x52, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0x7f, 0x0a,
+	0x11, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x56, 0x32, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02,
+	0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x65, 0x78,
+	0x61, 0x63, 0x74, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x65, 0x78, 0x61, 0x63, 0x74, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x1f, 0x0a,
+	0x0b, 0x6c, 0x69, 0x73, 0x74, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x04, 0x20, 0x03,
+	0x28, 0x01, 0x52, 0x0a, 0x6c, 0x69, 0x73, 0x74, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x32, 0x51,
+	0x0a, 0x10, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x72, 0x76, 0x69,
+	0x63, 0x65, 0x12, 0x3d, 0x0a, 0x04, 0x43, 0x61, 0x6c, 0x63, 0x12, 0x1a, 0x2e, 0x67, 0x65, 0x6f,
+	0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x67, 0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72,
+	0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x32, 0x57, 0x0a, 0x12, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65,
+	0x72, 0x76, 0x69, 0x63, 0x65, 0x56, 0x32, 0x12, 0x41, 0x0a, 0x04, 0x43, 0x61, 0x6c, 0x63, 0x12,
+	0x1c, 0x2e, 0x67, 0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x56, 0x32, 0x1a, 0x1b, 0x2e,
+	0x67, 0x65, 0x6f, 0x6d, 0x65, 0x74, 0x72, 0x79, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x56, 0x32, 0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x5a, 0x68, 0x65, 0x6c, 0x65, 0x7a, 0x6e,
+	0x6f, 0x76, 0x2d, 0x46, 0x65, 0x64, 0x6f, 0x72, 0x2f, 0x6e, 0x65, 0x77, 0x2d, 0x79, 0x61, 0x2d,
+	0x6c, 0x6f, 0x6e, 0x67, 0x2d, 0x63, 0x61, 0x6c, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
 }
 
 var (
@@ -184,19 +468,25 @@ func file_proto_operation_proto_rawDescGZIP() []byte {
 	return file_proto_operation_proto_rawDescData
 }
 
-var file_proto_operation_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_proto_operation_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_proto_operation_proto_goTypes = []interface{}{
-	(*OperationRequest)(nil), // 0: geometry.OperationRequest
-	(*OperationResult)(nil),  // 1: geometry.OperationResult
+	(*OperationRequest)(nil),   // 0: geometry.OperationRequest
+	(*OperationResult)(nil),    // 1: geometry.OperationResult
+	(*OperationRequestV2)(nil), // 2: geometry.OperationRequestV2
+	(*ListArg)(nil),            // 3: geometry.ListArg
+	(*OperationResultV2)(nil),  // 4: geometry.OperationResultV2
 }
 var file_proto_operation_proto_depIdxs = []int32{
-	0, // 0: geometry.OperationService.Calc:input_type -> geometry.OperationRequest
-	1, // 1: geometry.OperationService.Calc:output_type -> geometry.OperationResult
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	3, // 0: geometry.OperationRequestV2.lists:type_name -> geometry.ListArg
+	0, // 1: geometry.OperationService.Calc:input_type -> geometry.OperationRequest
+	2, // 2: geometry.OperationServiceV2.Calc:input_type -> geometry.OperationRequestV2
+	1, // 3: geometry.OperationService.Calc:output_type -> geometry.OperationResult
+	4, // 4: geometry.OperationServiceV2.Calc:output_type -> geometry.OperationResultV2
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_proto_operation_proto_init() }
@@ -229,6 +519,42 @@ func file_proto_operation_proto_init() {
 				return nil
 			}
 		}
+		file_proto_operation_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*OperationRequestV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_operation_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListArg); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_operation_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*OperationResultV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -236,9 +562,9 @@ func file_proto_operation_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_proto_operation_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   5,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_proto_operation_proto_goTypes,
 		DependencyIndexes: file_proto_operation_proto_depIdxs,
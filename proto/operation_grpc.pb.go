@@ -107,3 +107,93 @@ var OperationService_ServiceDesc = grpc.ServiceDesc{
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/operation.proto",
 }
+
+const (
+	OperationServiceV2_Calc_FullMethodName = "/geometry.OperationServiceV2/Calc"
+)
+
+// OperationServiceV2Client is the server API for OperationServiceV2 service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OperationServiceV2Client interface {
+	Calc(ctx context.Context, in *OperationRequestV2, opts ...grpc.CallOption) (*OperationResultV2, error)
+}
+
+type operationServiceV2Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOperationServiceV2Client(cc grpc.ClientConnInterface) OperationServiceV2Client {
+	return &operationServiceV2Client{cc}
+}
+
+func (c *operationServiceV2Client) Calc(ctx context.Context, in *OperationRequestV2, opts ...grpc.CallOption) (*OperationResultV2, error) {
+	out := new(OperationResultV2)
+	err := c.cc.Invoke(ctx, OperationServiceV2_Calc_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OperationServiceV2Server is the worker API for OperationServiceV2 service.
+// All implementations must embed UnimplementedOperationServiceV2Server
+// for forward compatibility
+type OperationServiceV2Server interface {
+	Calc(context.Context, *OperationRequestV2) (*OperationResultV2, error)
+	mustEmbedUnimplementedOperationServiceV2Server()
+}
+
+// UnimplementedOperationServiceV2Server must be embedded to have forward compatible implementations.
+type UnimplementedOperationServiceV2Server struct {
+}
+
+func (UnimplementedOperationServiceV2Server) Calc(context.Context, *OperationRequestV2) (*OperationResultV2, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Calc not implemented")
+}
+func (UnimplementedOperationServiceV2Server) mustEmbedUnimplementedOperationServiceV2Server() {}
+
+// UnsafeOperationServiceV2Server may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OperationServiceV2Server will
+// result in compilation errors.
+type UnsafeOperationServiceV2Server interface {
+	mustEmbedUnimplementedOperationServiceV2Server()
+}
+
+func RegisterOperationServiceV2Server(s grpc.ServiceRegistrar, srv OperationServiceV2Server) {
+	s.RegisterService(&OperationServiceV2_ServiceDesc, srv)
+}
+
+func _OperationServiceV2_Calc_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OperationRequestV2)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OperationServiceV2Server).Calc(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OperationServiceV2_Calc_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OperationServiceV2Server).Calc(ctx, req.(*OperationRequestV2))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// OperationServiceV2_ServiceDesc is the grpc.ServiceDesc for OperationServiceV2 service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OperationServiceV2_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "geometry.OperationServiceV2",
+	HandlerType: (*OperationServiceV2Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Calc",
+			Handler:    _OperationServiceV2_Calc_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/operation.proto",
+}
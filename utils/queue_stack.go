@@ -1,49 +1,52 @@
 package utils
 
-type Queue []string
+type Queue[T any] []T
 
-func (q *Queue) Put(n string) {
+func (q *Queue[T]) Put(n T) {
 	*q = append(*q, n)
 }
 
-func (q *Queue) Get() string {
+func (q *Queue[T]) Get() T {
+	var element T
 	if len(*q) == 0 {
-		return ""
+		return element
 	}
-	element := (*q)[0]
+	element = (*q)[0]
 	*q = (*q)[1:]
 	return element
 }
 
-func (q *Queue) IsEmpty() bool {
+func (q *Queue[T]) IsEmpty() bool {
 	return len(*q) == 0
 }
 
-type Stack []string
+type Stack[T any] []T
 
-func (s *Stack) Push(n string) {
+func (s *Stack[T]) Push(n T) {
 	*s = append(*s, n)
 }
 
-func (s *Stack) Pop() string {
+func (s *Stack[T]) Pop() T {
+	var element T
 	if len(*s) == 0 {
-		return ""
+		return element
 	}
 	index := len(*s) - 1
-	element := (*s)[index]
+	element = (*s)[index]
 	*s = (*s)[:index]
 	return element
 }
 
-func (s *Stack) IsEmpty() bool {
+func (s *Stack[T]) IsEmpty() bool {
 	return len(*s) == 0
 }
 
-func (s *Stack) Head() string {
+func (s *Stack[T]) Head() T {
+	var element T
 	if len(*s) == 0 {
-		return ""
+		return element
 	}
 	index := len(*s) - 1
-	element := (*s)[index]
+	element = (*s)[index]
 	return element
 }